@@ -6,10 +6,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cursor2api/internal/auth"
 	"cursor2api/internal/client"
 	"cursor2api/internal/config"
 	"cursor2api/internal/handler"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
 	"cursor2api/internal/token"
 
 	"github.com/gin-gonic/gin"
@@ -17,10 +28,23 @@ import (
 
 var log = logger.Get().WithPrefix("Main")
 
+const (
+	// readHeaderTimeout 读取请求头的超时时间，防止慢速连接长期占用服务
+	readHeaderTimeout = 10 * time.Second
+	// cancelGrace 取消请求后等待处理器写出错误并返回的最长时间
+	cancelGrace = time.Second
+)
+
 func main() {
 	// 加载配置
 	cfg := config.Get()
 
+	// 加载 API Key，配置了 Key 文件却无法读取时拒绝启动，避免在不认证的情况下对外服务
+	if err := auth.Get().Err(); err != nil {
+		log.Error("加载 API Key 失败: %v", err)
+		os.Exit(1)
+	}
+
 	// 初始化 Token Pool（预热 token，确保启动时就准备好）
 	log.Info("正在初始化 Token Pool...")
 	token.GetPool()
@@ -31,24 +55,51 @@ func main() {
 
 	// 创建 Gin 引擎
 	r := gin.Default()
+	// 限流按客户端 IP 计数，只信任配置的反向代理传入的 X-Forwarded-For/X-Real-IP
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Error("trusted_proxies 配置无效: %v", err)
+		os.Exit(1)
+	}
 
 	// ==================== 路由配置 ====================
 
+	// API 路由统计请求指标，并需要 API Key 认证（未配置 Key 时放行）
+	api := r.Group("/", handler.Metrics(), handler.RequireAPIKey())
+	// 生成类接口按 Key 和 IP 限流
+	gen := api.Group("/", handler.RateLimit())
+
 	// OpenAI 兼容接口
-	r.GET("/v1/models", handler.ListModels)
-	r.POST("/v1/chat/completions", handler.ChatCompletions)
+	api.GET("/v1/models", handler.ListModels)
+	gen.POST("/v1/chat/completions", handler.ChatCompletions)
+	gen.POST("/v1/completions", handler.Completions)
+	gen.POST("/v1/responses", handler.Responses)
+	api.GET("/v1/responses/:id", handler.GetResponse)
+	api.DELETE("/v1/responses/:id", handler.DeleteResponse)
 
 	// Anthropic Messages API 兼容接口
-	r.POST("/v1/messages", handler.Messages)
-	r.POST("/messages", handler.Messages)
-	r.POST("/v1/messages/count_tokens", handler.CountTokens)
-	r.POST("/messages/count_tokens", handler.CountTokens)
+	gen.POST("/v1/messages", handler.Messages)
+	gen.POST("/messages", handler.Messages)
+	api.POST("/v1/messages/count_tokens", handler.CountTokens)
+	api.POST("/messages/count_tokens", handler.CountTokens)
+
+	// Gemini generateContent 兼容接口，路径形如 /v1beta/models/{model}:generateContent
+	gen.POST("/v1beta/models/:action", handler.Gemini)
+
+	// Ollama 兼容接口
+	api.GET("/api/version", handler.OllamaVersion)
+	api.GET("/api/tags", handler.OllamaTags)
+	api.POST("/api/show", handler.OllamaShow)
+	gen.POST("/api/chat", handler.OllamaChat)
+	gen.POST("/api/generate", handler.OllamaGenerate)
 
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Prometheus 指标
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
 	// 客户端状态
 	r.GET("/status", func(c *gin.Context) {
 		svc := client.GetService()
@@ -62,9 +113,64 @@ func main() {
 		c.File("./static/index.html")
 	})
 
+	// 所有请求的 context 都派生自 baseCtx，排空超时后以 client.ErrShuttingDown 取消，中止仍在进行的上游请求
+	baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           r,
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
 	// 启动服务
-	log.Info("服务运行在端口 %s", cfg.Port)
-	if err := r.Run(":" + cfg.Port); err != nil {
-		log.Error("启动失败: %v", err)
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Info("服务运行在端口 %s", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	// 等待退出信号
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			log.Error("启动失败: %v", err)
+		}
+	case <-ctx.Done():
+		stop()
+		shutdown(srv, cancelRequests, time.Duration(cfg.ShutdownTimeout)*time.Second)
+	}
+
+	token.GetPool().Close()
+	logger.Sync()
+}
+
+// shutdown 停止接收新请求并等待进行中的请求（包括流式响应）完成
+// 超过 timeout 后取消剩余请求并强制关闭连接
+func shutdown(srv *http.Server, cancelRequests context.CancelCauseFunc, timeout time.Duration) {
+	log.Info("收到退出信号，停止接收新请求，等待进行中的请求完成 (最长 %s)...", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		log.Info("所有请求已完成")
+		return
+	}
+
+	log.Warn("等待超时，取消仍在进行的请求")
+	cancelRequests(client.ErrShuttingDown)
+	// 处理器按各协议向客户端写出错误（流式响应为错误事件）并返回，全部返回后 Shutdown 立即结束
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), cancelGrace)
+	defer graceCancel()
+	if err := srv.Shutdown(graceCtx); err == nil {
+		return
+	}
+	if err := srv.Close(); err != nil {
+		log.Error("关闭服务失败: %v", err)
 	}
 }
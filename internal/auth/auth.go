@@ -0,0 +1,183 @@
+// Package auth 提供客户端 API Key 认证和按 Key 的访问策略
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+)
+
+var log = logger.Get().WithPrefix("Auth")
+
+// Key 客户端 API Key 及其策略
+type Key struct {
+	// ID Key 的摘要，用于限流、统计等需要区分 Key 但不能暴露 Key 的场景
+	ID string
+	// Name 名称，用于日志显示
+	Name string
+	// Models 允许使用的模型，为空表示不限制
+	Models []string
+	// RateLimit 每分钟最多请求数，0 表示不限制
+	RateLimit int
+	// MaxConcurrency 最大并发请求数，0 表示不限制
+	MaxConcurrency int
+	// Labels 自定义标签
+	Labels map[string]string
+	// Disabled 是否已停用
+	Disabled bool
+}
+
+// AllowsModel 检查 Key 是否允许使用指定模型
+// 规则以 * 结尾时按前缀匹配，忽略大小写
+func (k *Key) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	model = strings.ToLower(model)
+	for _, rule := range k.Models {
+		rule = strings.ToLower(rule)
+		if rule == "*" || rule == model {
+			return true
+		}
+		if strings.HasSuffix(rule, "*") && strings.HasPrefix(model, strings.TrimSuffix(rule, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAnyModel 检查 Key 是否不限制模型（未配置 models 或包含 "*"）
+func (k *Key) AllowsAnyModel() bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, rule := range k.Models {
+		if rule == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticationError 缺少 API Key 或 Key 无效
+type AuthenticationError struct {
+	Message string
+}
+
+func (e *AuthenticationError) Error() string {
+	return e.Message
+}
+
+// PermissionError Key 有效但无权执行请求（已停用或不允许使用该模型）
+type PermissionError struct {
+	Message string
+}
+
+func (e *PermissionError) Error() string {
+	return e.Message
+}
+
+// Store API Key 存储
+type Store struct {
+	keys map[string]*Key
+	// err 加载 Key 失败的原因，不为空时拒绝所有请求
+	err error
+}
+
+var (
+	store     *Store
+	storeOnce sync.Once
+)
+
+// Get 获取全局 Key 存储（单例模式）
+func Get() *Store {
+	storeOnce.Do(func() {
+		cfg := config.Get().Auth
+		list := cfg.Keys
+		if cfg.KeysFile != "" {
+			fileKeys, err := config.LoadAPIKeyFile(cfg.KeysFile)
+			if err != nil {
+				// 配置了 Key 文件却无法读取时不能退化为不认证，拒绝所有请求
+				store = &Store{keys: map[string]*Key{}, err: fmt.Errorf("读取 Key 文件 %s 失败: %w", cfg.KeysFile, err)}
+				return
+			}
+			list = append(append(config.APIKeyList{}, list...), fileKeys...)
+		}
+
+		store = New(list)
+		if store.Enabled() {
+			log.Info("API Key 认证已启用: %d 个 Key", len(store.keys))
+		} else {
+			log.Warn("未配置 API Key，任何人都可以访问服务")
+		}
+	})
+	return store
+}
+
+// New 根据配置创建 Key 存储
+func New(list config.APIKeyList) *Store {
+	s := &Store{keys: make(map[string]*Key, len(list))}
+	for _, kc := range list {
+		if _, exists := s.keys[kc.Key]; exists {
+			log.Warn("API Key %s 重复定义，已忽略", maskKey(kc.Key))
+			continue
+		}
+		name := kc.Name
+		if name == "" {
+			name = maskKey(kc.Key)
+		}
+		sum := sha256.Sum256([]byte(kc.Key))
+		s.keys[kc.Key] = &Key{
+			ID:             hex.EncodeToString(sum[:8]),
+			Name:           name,
+			Models:         kc.Models,
+			RateLimit:      kc.RateLimit,
+			MaxConcurrency: kc.MaxConcurrency,
+			Labels:         kc.Labels,
+			Disabled:       kc.Disabled,
+		}
+	}
+	return s
+}
+
+// Enabled 是否启用认证（至少配置了一个 Key，或 Key 加载失败）
+func (s *Store) Enabled() bool {
+	return len(s.keys) > 0 || s.err != nil
+}
+
+// Err 返回加载 Key 失败的原因，加载成功时返回 nil
+func (s *Store) Err() error {
+	return s.err
+}
+
+// Authenticate 校验 API Key，返回对应的 Key 或 *AuthenticationError / *PermissionError
+// Key 加载失败时拒绝所有请求
+func (s *Store) Authenticate(secret string) (*Key, error) {
+	if s.err != nil {
+		return nil, &AuthenticationError{Message: "API keys are unavailable"}
+	}
+	if secret == "" {
+		return nil, &AuthenticationError{Message: "missing API key"}
+	}
+	k, ok := s.keys[secret]
+	if !ok {
+		return nil, &AuthenticationError{Message: fmt.Sprintf("invalid API key: %s", maskKey(secret))}
+	}
+	if k.Disabled {
+		return nil, &PermissionError{Message: fmt.Sprintf("API key '%s' is disabled", k.Name)}
+	}
+	return k, nil
+}
+
+// maskKey 只保留 Key 的前几位，避免写入日志
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:6] + "..."
+}
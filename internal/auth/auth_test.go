@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"cursor2api/internal/config"
+)
+
+func TestAllowsModel(t *testing.T) {
+	cases := []struct {
+		name    string
+		rules   []string
+		model   string
+		want    bool
+		wantAny bool
+	}{
+		{name: "no rules", model: "claude-4.5-opus", want: true, wantAny: true},
+		{name: "wildcard", rules: []string{"*"}, model: "anything", want: true, wantAny: true},
+		{name: "exact match ignores case", rules: []string{"Claude-4.5-Opus"}, model: "claude-4.5-opus", want: true},
+		{name: "prefix match", rules: []string{"claude-*"}, model: "claude-4.5-opus", want: true},
+		{name: "prefix mismatch", rules: []string{"gpt-*"}, model: "claude-4.5-opus"},
+		{name: "exact mismatch", rules: []string{"claude-4.5"}, model: "claude-4.5-opus"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			k := &Key{Models: tc.rules}
+			if got := k.AllowsModel(tc.model); got != tc.want {
+				t.Errorf("AllowsModel(%q) = %v, want %v", tc.model, got, tc.want)
+			}
+			if got := k.AllowsAnyModel(); got != tc.wantAny {
+				t.Errorf("AllowsAnyModel() = %v, want %v", got, tc.wantAny)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := New(config.APIKeyList{{Key: "sk-good", Name: "good"}, {Key: "sk-off", Disabled: true}})
+	var authErr *AuthenticationError
+	var permErr *PermissionError
+
+	if k, err := store.Authenticate("sk-good"); err != nil || k.Name != "good" {
+		t.Errorf("valid key: got %+v, %v", k, err)
+	}
+	if _, err := store.Authenticate(""); !errors.As(err, &authErr) {
+		t.Errorf("missing key: got %v, want *AuthenticationError", err)
+	}
+	if _, err := store.Authenticate("sk-bad"); !errors.As(err, &authErr) {
+		t.Errorf("wrong key: got %v, want *AuthenticationError", err)
+	}
+	if _, err := store.Authenticate("sk-off"); !errors.As(err, &permErr) {
+		t.Errorf("disabled key: got %v, want *PermissionError", err)
+	}
+	if !store.Enabled() || New(nil).Enabled() {
+		t.Error("Enabled should be true only when keys are configured")
+	}
+}
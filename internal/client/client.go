@@ -3,11 +3,19 @@
 package client
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"sync"
+	"time"
 
 	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
 	"cursor2api/internal/token"
 
 	"github.com/enetx/g"
@@ -61,32 +69,67 @@ func GetService() *Service {
 	return instance
 }
 
+var (
+	// errConnectTimeout 在超时时间内未收到上游响应头
+	errConnectTimeout = errors.New("连接 Cursor API 超时")
+	// errReadTimeout 在超时时间内未从上游读到新数据
+	errReadTimeout = errors.New("读取 Cursor API 响应超时")
+)
+
+// ErrShuttingDown 服务关闭时取消仍在进行的请求所用的原因（context.Cause）
+// 与客户端断开不同，处理器需要向客户端返回错误
+var ErrShuttingDown = errors.New("server is shutting down")
+
 // init 初始化 HTTP 客户端
 func (s *Service) init() {
-	s.surfClient = surf.NewClient().
+	builder := surf.NewClient().
 		Builder().
 		Impersonate().
-		Chrome().
-		Build()
+		Chrome()
 
-	log.Info("客户端初始化完成")
+	// 总超时：覆盖连接、发送请求和读取完整的流式响应
+	// 为 0 时也要显式设置，否则 surf 使用默认的 30 秒总超时
+	builder = builder.Timeout(time.Duration(s.cfg.RequestTimeout) * time.Second)
+	if s.cfg.Proxy != "" {
+		builder = builder.Proxy(s.cfg.Proxy)
+	}
+	s.surfClient = builder.Build()
+
+	log.Info("客户端初始化完成 (连接/读取超时: %ds, 总超时: %ds, 代理: %v)", s.cfg.Timeout, s.cfg.RequestTimeout, s.cfg.Proxy != "")
+}
+
+// timeout 返回连接和读取间隔的超时时间，未配置时为 0（不限制）
+func (s *Service) timeout() time.Duration {
+	if s.cfg.Timeout <= 0 {
+		return 0
+	}
+	return time.Duration(s.cfg.Timeout) * time.Second
 }
 
 // GetXIsHuman 获取当前 token（兼容旧接口）
 func (s *Service) GetXIsHuman() string {
-	return s.GetXIsHumanForKey("")
+	return s.GetXIsHumanForKey(context.Background(), "")
 }
 
-// GetXIsHumanForKey 获取指定 API Key 的 token
-func (s *Service) GetXIsHumanForKey(apiKey string) string {
-	t, err := token.GetPool().GetToken(apiKey)
+// GetXIsHumanForKey 获取指定 API Key 的 token，ctx 取消时中止 token 生成
+func (s *Service) GetXIsHumanForKey(ctx context.Context, apiKey string) string {
+	t, err := token.GetPool().GetToken(ctx, apiKey)
 	if err != nil {
+		if IsCanceled(err) {
+			log.Info("token 生成已取消: %v", err)
+			return ""
+		}
 		log.Error("获取 token 失败: %v", err)
 		return ""
 	}
 	return t
 }
 
+// IsCanceled 判断错误是否由请求取消（客户端断开）引起
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
 // CursorChatRequest Cursor API 请求格式
 type CursorChatRequest struct {
 	Context  []CursorContext `json:"context,omitempty"`
@@ -111,67 +154,159 @@ type CursorMessage struct {
 }
 
 // CursorPart 消息内容
+// Type 为 text 时使用 Text；为 file 时使用 MediaType 和 URL（可以是 data URL）
 type CursorPart struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// MarshalJSON 文件类型的 part 不输出 text 字段
+func (p CursorPart) MarshalJSON() ([]byte, error) {
+	if p.Type == "file" {
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			MediaType string `json:"mediaType"`
+			URL       string `json:"url"`
+		}{p.Type, p.MediaType, p.URL})
+	}
+	type plain CursorPart
+	return json.Marshal(plain(p))
 }
 
 // SendRequest 发送非流式请求
-func (s *Service) SendRequest(req CursorChatRequest) (string, error) {
-	return s.SendRequestWithIP(req, "")
+func (s *Service) SendRequest(ctx context.Context, req CursorChatRequest) (string, error) {
+	return s.SendRequestWithIP(ctx, req, "")
 }
 
 // SendRequestWithIP 发送非流式请求（带客户端 IP）
-func (s *Service) SendRequestWithIP(req CursorChatRequest, clientIP string) (string, error) {
-	return s.doRequest(req, nil, clientIP)
+func (s *Service) SendRequestWithIP(ctx context.Context, req CursorChatRequest, clientIP string) (string, error) {
+	return s.doRequest(ctx, req, nil, clientIP)
 }
 
 // SendStreamRequest 发送流式请求
-func (s *Service) SendStreamRequest(req CursorChatRequest, onChunk func(chunk string)) error {
-	return s.SendStreamRequestWithIP(req, onChunk, "")
+func (s *Service) SendStreamRequest(ctx context.Context, req CursorChatRequest, onChunk func(chunk string)) error {
+	return s.SendStreamRequestWithIP(ctx, req, onChunk, "")
 }
 
 // SendStreamRequestWithIP 发送流式请求（带客户端 IP）
-func (s *Service) SendStreamRequestWithIP(req CursorChatRequest, onChunk func(chunk string), clientIP string) error {
-	_, err := s.doRequest(req, onChunk, clientIP)
+func (s *Service) SendStreamRequestWithIP(ctx context.Context, req CursorChatRequest, onChunk func(chunk string), clientIP string) error {
+	_, err := s.doRequest(ctx, req, onChunk, clientIP)
 	return err
 }
 
 // doRequest 发送 API 请求
-func (s *Service) doRequest(req CursorChatRequest, onChunk func(chunk string), clientIP string) (string, error) {
-	headers := s.buildChatHeaders(clientIP)
+// onChunk 不为空时按行增量读取上游 SSE 响应体，每读到一行立即回调，返回值为空；
+// 否则读取完整响应体后返回。ctx 取消时中止上游请求并返回 context.Canceled
+func (s *Service) doRequest(ctx context.Context, req CursorChatRequest, onChunk func(chunk string), clientIP string) (string, error) {
+	headers := s.buildChatHeaders(ctx, clientIP)
+	if err := ctx.Err(); err != nil {
+		log.Info("请求已取消，未发送到 Cursor API: %v", err)
+		return "", err
+	}
+
+	// 连接超时和读超时通过取消 ctx 实现，对直连和代理同样生效
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timeout := s.timeout()
 
 	log.Debug("发送请求到 Cursor API: model=%s", req.Model)
 
-	resp := s.surfClient.Post(g.String(cursorChatAPI), req).SetHeaders(headers).Do()
+	var connectTimer *time.Timer
+	if timeout > 0 {
+		connectTimer = time.AfterFunc(timeout, func() { cancel(errConnectTimeout) })
+	}
+	resp := s.surfClient.Post(g.String(cursorChatAPI), req).SetHeaders(headers).WithContext(ctx).Do()
+	if connectTimer != nil {
+		connectTimer.Stop()
+	}
 	if resp.IsErr() {
+		if cause := context.Cause(ctx); cause != nil {
+			return "", logCause(cause, "Cursor API 请求")
+		}
+		metrics.UpstreamErrors.Inc("network")
 		log.Error("Cursor API 请求失败: %v", resp.Err())
 		return "", fmt.Errorf("请求失败: %w", resp.Err())
 	}
 
 	r := resp.Ok()
 	if r.StatusCode != 200 {
+		metrics.UpstreamErrors.Inc(strconv.Itoa(int(r.StatusCode)))
 		body := string(r.Body.String())
 		log.Error("Cursor API 返回错误: HTTP %d, 响应: %s", r.StatusCode, body)
 		return "", fmt.Errorf("HTTP %d: %s", r.StatusCode, body)
 	}
 
-	bodyStr := string(r.Body.String())
-	if onChunk != nil {
-		onChunk(bodyStr)
+	if onChunk == nil {
+		bodyStr := string(r.Body.String())
+		if cause := context.Cause(ctx); cause != nil {
+			return "", logCause(cause, "Cursor API 响应读取")
+		}
+		log.Debug("Cursor API 响应成功, 长度: %d", len(bodyStr))
+		return bodyStr, nil
 	}
 
-	log.Debug("Cursor API 响应成功, 长度: %d", len(bodyStr))
-	return bodyStr, nil
+	return "", streamBody(ctx, cancel, r.Body.Reader, s.timeout(), onChunk)
+}
+
+// streamBody 逐行读取响应体并回调，不等待上游响应结束
+// timeout 大于 0 时，两次读到数据的间隔超过 timeout 即以 errReadTimeout 中止
+func streamBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout time.Duration, onChunk func(chunk string)) error {
+	defer body.Close()
+
+	var readTimer *time.Timer
+	if timeout > 0 {
+		readTimer = time.AfterFunc(timeout, func() { cancel(errReadTimeout) })
+		defer readTimer.Stop()
+	}
+
+	reader := bufio.NewReader(body)
+	total := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if readTimer != nil {
+			readTimer.Reset(timeout)
+		}
+		if line != "" {
+			total += len(line)
+			onChunk(line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				return logCause(cause, fmt.Sprintf("Cursor API 流式响应(已接收 %d 字节)", total))
+			}
+			metrics.UpstreamErrors.Inc("network")
+			log.Error("读取 Cursor API 响应流失败: %v", err)
+			return fmt.Errorf("读取响应流失败: %w", err)
+		}
+	}
+
+	log.Debug("Cursor API 流式响应结束, 长度: %d", total)
+	return nil
+}
+
+// logCause 记录请求中止原因：客户端取消和服务关闭记为 Info，超时记为 Error
+func logCause(cause error, stage string) error {
+	if IsCanceled(cause) || errors.Is(cause, ErrShuttingDown) {
+		log.Info("%s已取消: %v", stage, cause)
+		return cause
+	}
+	metrics.UpstreamErrors.Inc("timeout")
+	log.Error("%s失败: %v", stage, cause)
+	return cause
 }
 
 // buildChatHeaders 构建聊天请求头
-func (s *Service) buildChatHeaders(clientIP string) map[string]string {
+func (s *Service) buildChatHeaders(ctx context.Context, clientIP string) map[string]string {
 	headers := make(map[string]string, len(chromeChatHeaders)+3)
 	for k, v := range chromeChatHeaders {
 		headers[k] = v
 	}
-	headers["x-is-human"] = s.GetXIsHuman()
+	headers["x-is-human"] = s.GetXIsHumanForKey(ctx, "")
 	// 转发客户端 IP
 	if clientIP != "" {
 		headers["X-Forwarded-For"] = clientIP
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// slowReader 每次 Read 返回 lines 中收到的一行，lines 关闭后返回 EOF
+// 在 ctx 取消时返回 ctx 错误，模拟取消后连接被关闭
+type slowReader struct {
+	ctx   context.Context
+	lines chan string
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	select {
+	case line, ok := <-r.lines:
+		if !ok {
+			return 0, io.EOF
+		}
+		return copy(p, line), nil
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+func (r *slowReader) Close() error { return nil }
+
+func TestStreamBody(t *testing.T) {
+	t.Run("chunk delivered before body ends", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		body := &slowReader{ctx: ctx, lines: make(chan string)}
+		got := make(chan string, 2)
+		done := make(chan error, 1)
+		go func() { done <- streamBody(ctx, cancel, body, time.Second, func(chunk string) { got <- chunk }) }()
+
+		body.lines <- "data: 1\n"
+		select {
+		case chunk := <-got:
+			if chunk != "data: 1\n" {
+				t.Errorf("got chunk %q", chunk)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("onChunk was not called before the body ended")
+		}
+		body.lines <- "data: 2\n"
+		close(body.lines)
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if chunk := <-got; chunk != "data: 2\n" {
+			t.Errorf("got chunk %q", chunk)
+		}
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		body := &slowReader{ctx: ctx, lines: make(chan string, 1)}
+		body.lines <- "data: 1\n"
+		var chunks int
+		err := streamBody(ctx, cancel, body, 50*time.Millisecond, func(string) { chunks++ })
+		if !errors.Is(err, errReadTimeout) {
+			t.Fatalf("got error %v, want errReadTimeout", err)
+		}
+		if chunks != 1 {
+			t.Errorf("got %d chunks before the timeout, want 1", chunks)
+		}
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	"gopkg.in/yaml.v3"
@@ -15,9 +18,13 @@ import (
 type Config struct {
 	// Port 服务监听端口
 	Port string `yaml:"port"`
-	// Timeout 请求超时时间（秒）
+	// Timeout 连接超时和流式读取间隔超时（秒），也是获取验证脚本的总超时，0 表示不限制
 	Timeout int `yaml:"timeout"`
-	// Proxy 代理地址
+	// RequestTimeout 单次聊天请求的总时长上限（秒），包括完整的流式响应，0 表示不限制
+	RequestTimeout int `yaml:"request_timeout"`
+	// ShutdownTimeout 收到退出信号后等待进行中请求完成的最长时间（秒）
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	// Proxy 代理地址，支持 http://、https://、socks5://，用于聊天请求和验证脚本获取
 	Proxy string `yaml:"proxy"`
 	// ScriptURL Cursor 验证脚本 URL
 	ScriptURL string `yaml:"script_url"`
@@ -25,10 +32,70 @@ type Config struct {
 	XIsHumanServerURL string `yaml:"x_is_human_server_url"`
 	// Fingerprint 浏览器指纹配置
 	Fingerprint FingerprintConfig `yaml:"fingerprint"`
-	// Models 支持的模型列表
-	Models string `yaml:"models"`
+	// Models 模型注册表，支持逗号分隔的字符串或详细的模型列表
+	Models ModelList `yaml:"models"`
+	// DefaultUpstreamModel 未指定 upstream 的模型实际请求的上游模型
+	DefaultUpstreamModel string `yaml:"default_upstream_model"`
+	// StrictModels 为 true 时拒绝注册表之外的模型，否则映射到默认上游模型
+	StrictModels bool `yaml:"strict_models"`
 	// TokenPoolSize Token 轮询池大小
 	TokenPoolSize int `yaml:"token_pool_size"`
+	// ToolMode 工具调用协议模式: generic（描述真实工具定义）或 vm（固定的虚拟机标签）
+	ToolMode string `yaml:"tool_mode"`
+	// ToolValidation 工具调用参数校验配置
+	ToolValidation ToolValidationConfig `yaml:"tool_validation"`
+	// ReasoningContent OpenAI Chat 响应中推理内容的输出方式:
+	// field（reasoning_content 字段）、inline（以 <think> 标签放在 content 前）、strip（丢弃）
+	ReasoningContent string `yaml:"reasoning_content"`
+	// Auth 客户端 API Key 认证配置
+	Auth AuthConfig `yaml:"auth"`
+	// TrustedProxies 可信的反向代理地址（IP 或 CIDR），只有来自这些地址的请求才采用
+	// X-Forwarded-For/X-Real-IP 作为客户端 IP，为空时使用连接的来源地址
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// RateLimit 限流配置
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// Responses Responses API 配置
+	Responses ResponsesConfig `yaml:"responses"`
+}
+
+// ResponsesConfig Responses API 配置
+type ResponsesConfig struct {
+	// StoreSize 最多保存的响应数，用于 previous_response_id 续接对话，0 表示不保存
+	StoreSize int `yaml:"store_size"`
+	// StoreTTL 响应保存时间（分钟），0 表示不过期
+	StoreTTL int `yaml:"store_ttl"`
+}
+
+// RateLimitConfig 限流配置，API Key 自身配置的 rate_limit/max_concurrency 优先于 per_key
+type RateLimitConfig struct {
+	// PerKey 每个 API Key 的默认限制
+	PerKey LimitConfig `yaml:"per_key"`
+	// PerIP 每个客户端 IP 的限制
+	PerIP LimitConfig `yaml:"per_ip"`
+}
+
+// LimitConfig 单个调用方的限制，0 表示不限制
+type LimitConfig struct {
+	// RequestsPerMinute 每分钟最多请求数
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	// MaxConcurrency 最大并发请求数（包括进行中的流式响应）
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+// AuthConfig 客户端 API Key 认证配置，未配置任何 Key 时不启用认证
+type AuthConfig struct {
+	// Keys 允许访问的 API Key 列表
+	Keys APIKeyList `yaml:"keys"`
+	// KeysFile 额外的 Key 文件，格式与 keys 相同，也可以每行一个 Key
+	KeysFile string `yaml:"keys_file"`
+}
+
+// ToolValidationConfig 工具调用参数校验配置
+type ToolValidationConfig struct {
+	// Mode 校验失败时的处理方式: off（不校验）、error（返回错误）、reprompt（要求模型重新输出）
+	Mode string `yaml:"mode"`
+	// MaxRetries reprompt 模式下最多重新请求的次数，用尽后返回错误
+	MaxRetries int `yaml:"max_retries"`
 }
 
 // FingerprintConfig 浏览器指纹配置
@@ -46,13 +113,38 @@ var (
 	once sync.Once
 )
 
+// defaultModels 未配置 models 时提供的模型，只列出按名称实际提供的 claude-4.5-opus
+// 旧版默认列表中的其他模型名作为别名保留，请求这些名称时同样由 claude-4.5-opus 处理
+var defaultModels = ModelList{
+	{
+		ID:       "claude-4.5-opus",
+		Upstream: "claude-opus-4-5-20251101",
+		Aliases: []string{
+			"claude-opus-4-5", "claude-opus-4-5-20251101",
+			"claude-4.5-sonnet", "composer-1", "gemini-3-flash", "gemini-3-pro", "gpt-5.1-codex-max", "gpt-5.2", "grok-code",
+		},
+	},
+}
+
 // Get 获取全局配置实例（单例模式）
 func Get() *Config {
 	once.Do(func() {
 		cfg = &Config{
-			Port:    "3010",
-			Timeout: 60,
-			Models:  "gpt-4o,claude-3.5-sonnet,claude-3.7-sonnet",
+			Port:                 "3010",
+			Timeout:              60,
+			ShutdownTimeout:      30,
+			Models:               defaultModels,
+			DefaultUpstreamModel: "claude-opus-4-5-20251101",
+			ToolMode:             "generic",
+			ReasoningContent:     "field",
+			ToolValidation: ToolValidationConfig{
+				Mode:       "reprompt",
+				MaxRetries: 1,
+			},
+			Responses: ResponsesConfig{
+				StoreSize: 1000,
+				StoreTTL:  60,
+			},
 			Fingerprint: FingerprintConfig{
 				UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/139.0.0.0 Safari/537.36",
 			},
@@ -80,6 +172,16 @@ func load(c *Config) {
 	if port := os.Getenv("PORT"); port != "" {
 		c.Port = port
 	}
+	if requestTimeout := os.Getenv("REQUEST_TIMEOUT"); requestTimeout != "" {
+		if v, err := strconv.Atoi(requestTimeout); err == nil {
+			c.RequestTimeout = v
+		}
+	}
+	if shutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); shutdownTimeout != "" {
+		if v, err := strconv.Atoi(shutdownTimeout); err == nil {
+			c.ShutdownTimeout = v
+		}
+	}
 	if proxy := os.Getenv("PROXY"); proxy != "" {
 		c.Proxy = proxy
 	}
@@ -99,11 +201,32 @@ func load(c *Config) {
 		}
 	}
 	if models := os.Getenv("MODELS"); models != "" {
-		c.Models = models
+		c.Models = ParseModelList(models)
+	}
+	if strict := os.Getenv("STRICT_MODELS"); strict != "" {
+		c.StrictModels = strict == "true" || strict == "1"
+	}
+	if apiKeys := os.Getenv("API_KEYS"); apiKeys != "" {
+		c.Auth.Keys = append(c.Auth.Keys, ParseAPIKeyList(apiKeys)...)
+	}
+	if keysFile := os.Getenv("API_KEYS_FILE"); keysFile != "" {
+		c.Auth.KeysFile = keysFile
+	}
+	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+		c.TrustedProxies = strings.Split(trustedProxies, ",")
+	}
+	if toolMode := os.Getenv("TOOL_MODE"); toolMode != "" {
+		c.ToolMode = toolMode
+	}
+	if reasoningContent := os.Getenv("REASONING_CONTENT"); reasoningContent != "" {
+		c.ReasoningContent = reasoningContent
 	}
 
 	// 输出最终配置
-	log.Printf("[配置] 端口: %s, 超时: %ds", c.Port, c.Timeout)
+	log.Printf("[配置] 端口: %s, 超时: %ds, 工具模式: %s, 模型数: %d", c.Port, c.Timeout, c.ToolMode, len(c.Models))
+	if c.Proxy != "" {
+		log.Printf("[配置] 代理: %s", redactProxy(c.Proxy))
+	}
 	if c.ScriptURL != "" {
 		log.Printf("[配置] ScriptURL: %s", c.ScriptURL)
 	}
@@ -111,3 +234,12 @@ func load(c *Config) {
 		log.Printf("[配置] XIsHumanServerURL: %s", c.XIsHumanServerURL)
 	}
 }
+
+// redactProxy 隐藏代理地址中的密码，避免写入日志
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "(无效的代理地址)"
+	}
+	return u.Redacted()
+}
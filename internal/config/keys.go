@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyConfig 单个客户端 API Key 及其策略
+type APIKeyConfig struct {
+	// Key API Key 本身
+	Key string `yaml:"key"`
+	// Name 名称，用于日志显示，为空时使用 Key 的前几位
+	Name string `yaml:"name"`
+	// Models 允许使用的模型 ID，支持 "claude-*" 形式的前缀匹配，为空表示不限制
+	Models []string `yaml:"models"`
+	// RateLimit 每分钟最多请求数，0 表示不限制
+	RateLimit int `yaml:"rate_limit"`
+	// MaxConcurrency 最大并发请求数，0 表示不限制
+	MaxConcurrency int `yaml:"max_concurrency"`
+	// Labels 自定义标签，会写入请求日志
+	Labels map[string]string `yaml:"labels"`
+	// Disabled 停用该 Key，请求返回 403
+	Disabled bool `yaml:"disabled"`
+}
+
+// APIKeyList API Key 列表
+// YAML 中可以写成逗号或空白分隔的字符串，也可以写成列表，
+// 列表项可以是 Key 字符串或完整的 APIKeyConfig
+type APIKeyList []APIKeyConfig
+
+// UnmarshalYAML 实现 yaml.Unmarshaler
+func (l *APIKeyList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*l = ParseAPIKeyList(node.Value)
+		return nil
+	case yaml.SequenceNode:
+		list := make(APIKeyList, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				list = append(list, ParseAPIKeyList(item.Value)...)
+				continue
+			}
+			var k APIKeyConfig
+			if err := item.Decode(&k); err != nil {
+				return err
+			}
+			if k.Key == "" {
+				return fmt.Errorf("第 %d 行的 API Key 缺少 key", item.Line)
+			}
+			list = append(list, k)
+		}
+		*l = list
+		return nil
+	}
+	return fmt.Errorf("第 %d 行: keys 必须是字符串或列表", node.Line)
+}
+
+// ParseAPIKeyList 解析逗号或空白分隔的 API Key 列表
+func ParseAPIKeyList(s string) APIKeyList {
+	var list APIKeyList
+	for _, key := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		list = append(list, APIKeyConfig{Key: key})
+	}
+	return list
+}
+
+// LoadAPIKeyFile 读取 Key 文件
+// 文件可以是 YAML 列表、带 keys 字段的 YAML 对象，或每行一个 Key 的纯文本
+func LoadAPIKeyFile(path string) (APIKeyList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+
+	var list APIKeyList
+	if root.Kind == yaml.MappingNode {
+		var wrapper struct {
+			Keys APIKeyList `yaml:"keys"`
+		}
+		if err := root.Decode(&wrapper); err != nil {
+			return nil, err
+		}
+		return wrapper.Keys, nil
+	}
+	if err := root.Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
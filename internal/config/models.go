@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ModelConfig 单个模型的配置
+type ModelConfig struct {
+	// ID 对外暴露的模型 ID
+	ID string `yaml:"id"`
+	// Upstream 实际请求的上游模型，为空时使用 default_upstream_model
+	Upstream string `yaml:"upstream"`
+	// ReasoningUpstream 客户端请求思考（thinking / reasoning_effort）时使用的上游模型，为空时使用 upstream
+	ReasoningUpstream string `yaml:"reasoning_upstream"`
+	// Aliases 模型别名，请求中使用别名等同于使用 ID
+	Aliases []string `yaml:"aliases"`
+	// ContextWindow 上下文窗口大小（token），0 表示使用默认值
+	ContextWindow int `yaml:"context_window"`
+	// MaxOutput 最大输出 token 数，0 表示使用默认值
+	MaxOutput int `yaml:"max_output"`
+	// Capabilities 模型能力: tools、vision、reasoning，未配置时视为全部支持
+	Capabilities []string `yaml:"capabilities"`
+	// OwnedBy 模型列表中显示的所有者
+	OwnedBy string `yaml:"owned_by"`
+}
+
+// ModelList 模型列表
+// YAML 中可以写成逗号分隔的字符串（兼容旧配置），也可以写成列表，
+// 列表项可以是模型 ID 字符串或完整的 ModelConfig
+type ModelList []ModelConfig
+
+// UnmarshalYAML 实现 yaml.Unmarshaler
+func (l *ModelList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*l = ParseModelList(node.Value)
+		return nil
+	case yaml.SequenceNode:
+		list := make(ModelList, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				list = append(list, ParseModelList(item.Value)...)
+				continue
+			}
+			var m ModelConfig
+			if err := item.Decode(&m); err != nil {
+				return err
+			}
+			if m.ID == "" {
+				return fmt.Errorf("第 %d 行的模型缺少 id", item.Line)
+			}
+			list = append(list, m)
+		}
+		*l = list
+		return nil
+	}
+	return fmt.Errorf("第 %d 行: models 必须是字符串或列表", node.Line)
+}
+
+// ParseModelList 解析逗号分隔的模型 ID 列表
+func ParseModelList(s string) ModelList {
+	var list ModelList
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			list = append(list, ModelConfig{ID: id})
+		}
+	}
+	return list
+}
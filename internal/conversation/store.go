@@ -0,0 +1,117 @@
+// Package conversation 提供 Responses API 的本地会话存储，用于 previous_response_id 续接对话
+package conversation
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+)
+
+var log = logger.Get().WithPrefix("Conversation")
+
+// Entry 一次响应及其之前的对话
+type Entry struct {
+	// ID 响应 ID
+	ID string
+	// Messages 截止到该响应（包括响应本身）的对话消息，不含系统指令和工具提示词
+	Messages []client.CursorMessage
+	// HasToolResult 对话中是否已有工具执行结果
+	HasToolResult bool
+	// Response 返回给客户端的响应对象，用于查询接口
+	Response interface{}
+	// KeyID 创建该响应的 API Key ID，未启用认证时为空
+	KeyID string
+
+	created time.Time
+}
+
+// Store 内存中的会话存储，超过容量时淘汰最早的响应
+type Store struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // 按写入时间排序，元素为 *Entry
+	entries map[string]*list.Element
+}
+
+var (
+	store     *Store
+	storeOnce sync.Once
+)
+
+// Get 获取全局会话存储（单例模式）
+func Get() *Store {
+	storeOnce.Do(func() {
+		cfg := config.Get().Responses
+		store = New(cfg.StoreSize, time.Duration(cfg.StoreTTL)*time.Minute)
+		log.Info("会话存储: 容量 %d, 保留 %d 分钟", cfg.StoreSize, cfg.StoreTTL)
+	})
+	return store
+}
+
+// New 创建会话存储，size 为 0 时不保存任何响应，ttl 为 0 时不过期
+func New(size int, ttl time.Duration) *Store {
+	return &Store{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Put 保存响应，相同 ID 的旧记录会被替换
+func (s *Store) Put(entry *Entry) {
+	if s.size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.ID]; ok {
+		s.order.Remove(elem)
+	}
+	entry.created = time.Now()
+	s.entries[entry.ID] = s.order.PushBack(entry)
+
+	for s.order.Len() > s.size {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*Entry).ID)
+	}
+}
+
+// Load 读取响应，不存在或已过期时返回 false
+func (s *Store) Load(id string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*Entry)
+	if s.ttl > 0 && time.Since(entry.created) > s.ttl {
+		s.order.Remove(elem)
+		delete(s.entries, id)
+		return nil, false
+	}
+	return entry, true
+}
+
+// Delete 删除响应，返回是否存在
+func (s *Store) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[id]
+	if !ok {
+		return false
+	}
+	s.order.Remove(elem)
+	delete(s.entries, id)
+	return true
+}
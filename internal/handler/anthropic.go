@@ -3,12 +3,20 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
 
+	"cursor2api/internal/auth"
 	"cursor2api/internal/client"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/ratelimit"
 	"cursor2api/internal/toolify"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +35,40 @@ type MessagesRequest struct {
 	Stream    bool                     `json:"stream"`
 	System    interface{}              `json:"system,omitempty"` // 可以是 string 或 []ContentBlock
 	Tools     []toolify.ToolDefinition `json:"tools,omitempty"`
+	Thinking  *ThinkingConfig          `json:"thinking,omitempty"`
+	// StopSequences 停止序列，生成的文本中出现任一序列时截断输出
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	// ToolChoice 工具调用约束，未指定时为 auto
+	ToolChoice *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// AnthropicToolChoice tool_choice 参数
+type AnthropicToolChoice struct {
+	// Type auto / any / tool / none
+	Type string `json:"type"`
+	// Name Type 为 tool 时必须调用的工具
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// toolChoice 转换为 toolify 的工具调用约束
+func (t *AnthropicToolChoice) toolChoice() toolify.ToolChoice {
+	if t == nil {
+		return toolify.ToolChoice{Type: "auto"}
+	}
+	return toolify.ToolChoice{Type: t.Type, Name: t.Name, DisableParallel: t.DisableParallelToolUse}
+}
+
+// ThinkingConfig 扩展思考配置
+type ThinkingConfig struct {
+	// Type enabled 或 disabled
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// enabled 是否请求了思考内容
+func (t *ThinkingConfig) enabled() bool {
+	return t != nil && t.Type == "enabled"
 }
 
 // Message 消息格式
@@ -49,11 +91,13 @@ type MessagesResponse struct {
 
 // ContentBlock 内容块
 type ContentBlock struct {
-	Type  string                 `json:"type"`
-	Text  string                 `json:"text,omitempty"`
-	ID    string                 `json:"id,omitempty"`    // tool_use
-	Name  string                 `json:"name,omitempty"`  // tool_use
-	Input map[string]interface{} `json:"input,omitempty"` // tool_use
+	Type      string                 `json:"type"`
+	Text      string                 `json:"text,omitempty"`
+	ID        string                 `json:"id,omitempty"`        // tool_use
+	Name      string                 `json:"name,omitempty"`      // tool_use
+	Input     map[string]interface{} `json:"input,omitempty"`     // tool_use
+	Thinking  string                 `json:"thinking,omitempty"`  // thinking
+	Signature string                 `json:"signature,omitempty"` // thinking
 }
 
 // Usage token 使用统计
@@ -62,12 +106,6 @@ type Usage struct {
 	OutputTokens int `json:"output_tokens"`
 }
 
-// CursorSSEEvent Cursor SSE 事件格式
-type CursorSSEEvent struct {
-	Type  string `json:"type"`
-	Delta string `json:"delta,omitempty"`
-}
-
 // ================== 辅助函数 ==================
 
 // generateID 生成唯一标识符
@@ -101,36 +139,22 @@ func getTextContent(content interface{}) string {
 	}
 }
 
-// mapModelName 将模型名称映射到 Cursor 支持的格式
-func mapModelName(model string) string {
-	// 统一使用 claude-opus-4-5-20251101
-	const targetModel = "claude-opus-4-5-20251101"
-	if model != targetModel {
-		log.Debug("模型映射: %s -> %s", model, targetModel)
-	}
-	return targetModel
-}
-
 // ================== 处理器函数 ==================
 
-// CountTokens 估算 token 数量
+// CountTokens 统计请求的输入 token 数
+// 与 Messages 使用相同的转换逻辑，包含系统提示词、工具定义和注入的工具提示词
 func CountTokens(c *gin.Context) {
 	var req MessagesRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error()}})
 		return
 	}
-
-	// 简单估算：每 4 个字符约 1 个 token
-	totalChars := len(getTextContent(req.System))
-	for _, msg := range req.Messages {
-		totalChars += len(getTextContent(msg.Content))
-	}
-	tokens := totalChars / 4
-	if tokens < 1 {
-		tokens = 1
+	if err := applyToolChoice(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		return
 	}
 
+	tokens := countInputTokens(convertToCursor(req, ""))
 	c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
 }
 
@@ -169,6 +193,11 @@ func Messages(c *gin.Context) {
 		return
 	}
 
+	if err := applyToolChoice(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		return
+	}
+
 	// 记录请求参数
 	log.Info("[Anthropic] 请求参数:")
 	log.Info("  模型: %s", req.Model)
@@ -178,6 +207,10 @@ func Messages(c *gin.Context) {
 	if len(req.Tools) > 0 {
 		log.Info("  工具数: %d", len(req.Tools))
 	}
+	thinking := req.Thinking.enabled()
+	if thinking {
+		log.Info("  思考预算: %d", req.Thinking.BudgetTokens)
+	}
 
 	// 记录消息内容
 	for i, msg := range req.Messages {
@@ -188,22 +221,42 @@ func Messages(c *gin.Context) {
 		log.Debug("  消息[%d] 角色=%s 内容=%s", i, msg.Role, content)
 	}
 
-	// 转换为 Cursor 请求格式
-	cursorReq := convertToCursor(req)
+	required := models.Capabilities{Tools: len(req.Tools) > 0, Vision: hasImageBlocks(req), Reasoning: thinking}
+	model, err := resolveModel(c, req.Model, required)
+	if err != nil {
+		log.Warn("[Anthropic] %v", err)
+		c.JSON(errorStatus(err), anthropicErrorBody(err))
+		return
+	}
+
+	// 转换为 Cursor 请求格式，请求思考时使用模型的推理上游
+	cursorReq := convertToCursor(req, model.UpstreamFor(thinking))
 	clientIP := getClientIP(c)
 	log.Debug("[Anthropic] 客户端 IP: %s", clientIP)
+	opts := generateOptions{
+		Tools:      req.Tools,
+		ClientIP:   clientIP,
+		Model:      c.GetString(modelContextKey),
+		Stop:       req.StopSequences,
+		MaxTokens:  maxOutputTokens(req.MaxTokens, model),
+		ToolChoice: req.ToolChoice.toolChoice(),
+	}
+	if thinking {
+		opts.ReturnReasoning = true
+		opts.ReasoningBudget = req.Thinking.BudgetTokens
+	}
 
 	if req.Stream {
-		handleStream(c, cursorReq, req.Model, req.Tools, clientIP)
+		handleStream(c, cursorReq, req.Model, opts, thinking)
 	} else {
-		handleNonStream(c, cursorReq, req.Model, req.Tools, clientIP)
+		handleNonStream(c, cursorReq, req.Model, opts, thinking)
 	}
 }
 
 // ================== 请求转换 ==================
 
 // convertToCursor 将 Anthropic 请求转换为 Cursor 格式
-func convertToCursor(req MessagesRequest) client.CursorChatRequest {
+func convertToCursor(req MessagesRequest, upstreamModel string) client.CursorChatRequest {
 	messages := make([]client.CursorMessage, 0, len(req.Messages)+1)
 
 	// 构建系统消息
@@ -233,37 +286,36 @@ func convertToCursor(req MessagesRequest) client.CursorChatRequest {
 		}
 	}
 
-	// 只有第一次调用时才注入工具提示（没有 tool_result）
-	toolPrompt := ""
-	if len(req.Tools) > 0 && !hasToolResult {
-		toolPrompt = toolify.GenerateToolPrompt(req.Tools)
-		log.Info("[Anthropic] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(req.Tools))
-		log.Debug("[Anthropic] 工具提示词内容:\n%s", toolPrompt)
-	} else if len(req.Tools) > 0 && hasToolResult {
-		log.Debug("[Anthropic] 跳过工具提示词注入 (已有 tool_result)")
-	}
-
 	// 添加用户/助手消息
-	firstUserMsg := true
 	for _, msg := range req.Messages {
 		text := extractMessageText(msg)
+		images := extractImageParts(msg.Content)
+		if text == "" && len(images) == 0 {
+			continue
+		}
+		parts := make([]client.CursorPart, 0, len(images)+1)
 		if text != "" {
-			// 把工具提示放在第一条用户消息前面
-			if msg.Role == "user" && firstUserMsg && toolPrompt != "" {
-				log.Debug("[Anthropic] 工具提示词已注入到第一条用户消息")
-				text = toolPrompt + "\n\n" + text
-				firstUserMsg = false
-			}
-			messages = append(messages, client.CursorMessage{
-				Parts: []client.CursorPart{{Type: "text", Text: text}},
-				ID:    generateID(),
-				Role:  msg.Role,
-			})
+			parts = append(parts, client.CursorPart{Type: "text", Text: text})
 		}
+		parts = append(parts, images...)
+		messages = append(messages, client.CursorMessage{
+			Parts: parts,
+			ID:    generateID(),
+			Role:  msg.Role,
+		})
+	}
+
+	// 把工具提示放在第一条用户消息前面
+	messages, toolPrompt := toolify.InjectPrompt(messages, req.Tools, req.ToolChoice.toolChoice(), hasToolResult)
+	if toolPrompt != "" {
+		log.Info("[Anthropic] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(req.Tools))
+		log.Debug("[Anthropic] 工具提示词内容:\n%s", toolPrompt)
+	} else if len(req.Tools) > 0 && hasToolResult {
+		log.Debug("[Anthropic] 跳过工具提示词注入 (已有 tool_result)")
 	}
 
 	return client.CursorChatRequest{
-		Model:    mapModelName(req.Model),
+		Model:    upstreamModel,
 		ID:       generateID(),
 		Messages: messages,
 		Trigger:  "submit-message",
@@ -292,6 +344,12 @@ func extractMessageText(msg Message) string {
 				if text, ok := block["text"].(string); ok {
 					texts = append(texts, text)
 				}
+			case "tool_use":
+				// 还原历史中的工具调用，让模型看到自己之前的调用
+				name, _ := block["name"].(string)
+				if call := toolify.FormatToolCall(name, block["input"]); call != "" {
+					texts = append(texts, call)
+				}
 			case "tool_result":
 				// 提取 tool_result 内容
 				toolID := ""
@@ -321,198 +379,360 @@ func extractMessageText(msg Message) string {
 	}
 }
 
+// extractImageParts 提取消息中的 image 块（包括 tool_result 中的图片），转换为上游的 file part
+func extractImageParts(content interface{}) []client.CursorPart {
+	blocks, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+	var parts []client.CursorPart
+	for _, item := range blocks {
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch block["type"] {
+		case "image":
+			if part, ok := anthropicImagePart(block); ok {
+				parts = append(parts, part)
+			}
+		case "tool_result":
+			parts = append(parts, extractImageParts(block["content"])...)
+		}
+	}
+	return parts
+}
+
+// anthropicImagePart 将 image 块的 source 转换为 file part，支持 base64 和 url 两种来源
+func anthropicImagePart(block map[string]interface{}) (client.CursorPart, bool) {
+	source, ok := block["source"].(map[string]interface{})
+	if !ok {
+		return client.CursorPart{}, false
+	}
+	mediaType, _ := source["media_type"].(string)
+	switch source["type"] {
+	case "base64":
+		data, _ := source["data"].(string)
+		if data == "" {
+			return client.CursorPart{}, false
+		}
+		if mediaType == "" {
+			mediaType = "image/png"
+		}
+		return imagePart(mediaType, "data:"+mediaType+";base64,"+data), true
+	case "url":
+		url, _ := source["url"].(string)
+		if url == "" {
+			return client.CursorPart{}, false
+		}
+		return imagePart(mediaType, url), true
+	}
+	log.Warn("[Anthropic] 不支持的图片来源类型: %v", source["type"])
+	return client.CursorPart{}, false
+}
+
+// imagePart 创建图片 file part，未知类型时从 data URL 的头部或 URL 的扩展名推断
+func imagePart(mediaType, url string) client.CursorPart {
+	if mediaType == "" && strings.HasPrefix(url, "data:") {
+		header := strings.TrimPrefix(url, "data:")
+		if i := strings.IndexAny(header, ";,"); i >= 0 {
+			mediaType = header[:i]
+		}
+	}
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(path.Ext(strings.SplitN(url, "?", 2)[0]))
+		if !strings.HasPrefix(mediaType, "image/") {
+			mediaType = "image/*"
+		}
+	}
+	return client.CursorPart{Type: "file", MediaType: mediaType, URL: url}
+}
+
+// applyToolChoice 按 tool_choice 调整请求，Messages 与 CountTokens 共用
+// tool_choice 为 none 时不注入工具，历史中的工具调用仍然保留；指定工具名时统一为声明的名称
+func applyToolChoice(req *MessagesRequest) error {
+	choice := req.ToolChoice.toolChoice()
+	if choice.Type == "none" {
+		log.Debug("[Anthropic] tool_choice=none, 不注入工具")
+		req.Tools = nil
+	}
+	if err := validateToolChoice(choice, req.Tools); err != nil {
+		return err
+	}
+	if choice.Type == "tool" {
+		tool, _ := toolify.FindTool(choice.Name, req.Tools)
+		req.ToolChoice.Name = tool.GetName()
+	}
+	return nil
+}
+
+// validateToolChoice 检查 tool_choice 与请求中的工具是否匹配
+// 工具名的匹配规则与 toolify.FindTool 一致：优先精确匹配，其次忽略大小写
+func validateToolChoice(choice toolify.ToolChoice, tools []toolify.ToolDefinition) error {
+	switch choice.Type {
+	case "auto", "none":
+		return nil
+	case "any":
+		if len(tools) == 0 {
+			return fmt.Errorf("tool_choice.type 'any' requires at least one tool")
+		}
+		return nil
+	case "tool":
+		if _, ok := toolify.FindTool(choice.Name, tools); ok {
+			return nil
+		}
+		return fmt.Errorf("tool_choice.name '%s' does not match any of the provided tools", choice.Name)
+	}
+	return fmt.Errorf("tool_choice.type must be one of auto, any, tool, none")
+}
+
+// thinkingSignature 生成 thinking 块的签名
+// 上游不提供签名，这里使用思考内容的摘要，客户端在后续请求中原样回传即可
+func thinkingSignature(thinking string) string {
+	sum := sha256.Sum256([]byte(thinking))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasImageBlocks 检查请求中是否包含图片
+func hasImageBlocks(req MessagesRequest) bool {
+	for _, msg := range req.Messages {
+		if len(extractImageParts(msg.Content)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // ================== API 处理 ==================
 
 // handleStream 处理流式请求
-func handleStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
+// thinking 为 true 时上游的推理内容以 thinking 块输出，否则丢弃
+func handleStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, opts generateOptions, thinking bool) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Header("X-Accel-Buffering", "no")
 
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
 	flusher, _ := c.Writer.(http.Flusher)
 	id := "msg_" + generateID()
+	inputTokens := countInputTokens(cursorReq)
 
 	// 发送 message_start
 	_, _ = c.Writer.WriteString("event: message_start\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_start","message":{"id":"%s","type":"message","role":"assistant","content":[],"model":"%s","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":100,"output_tokens":0}}}`+"\n\n", id, model)
+	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_start","message":{"id":"%s","type":"message","role":"assistant","content":[],"model":"%s","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":%d,"output_tokens":0}}}`+"\n\n", id, model, inputTokens)
 	flusher.Flush()
 
-	var buffer, fullResponse strings.Builder
 	blockIndex := 0
-	toolCount := 0
 
-	// 发送工具调用的辅助函数
-	sendToolCall := func(toolName, argsJSON string) {
-		toolID := fmt.Sprintf("toolu_%d", toolCount)
-		toolCount++
-
-		var args map[string]any
-		_ = json.Unmarshal([]byte(argsJSON), &args)
-		inputJSON, _ := json.Marshal(args)
-		partialJSONStr, _ := json.Marshal(string(inputJSON))
+	// 标记是否已发送文本块开始
+	textBlockStarted := false
+	// 文本块开始前的空白先暂存，避免工具调用之间出现只有换行的文本块
+	pendingSpace := ""
 
-		_, _ = c.Writer.WriteString("event: content_block_start\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"%s","name":"%s","input":{}}}`+"\n\n", blockIndex, toolID, toolName)
-		_, _ = c.Writer.WriteString("event: content_block_delta\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":%s}}`+"\n\n", blockIndex, string(partialJSONStr))
+	closeTextBlock := func() {
+		if !textBlockStarted {
+			return
+		}
 		_, _ = c.Writer.WriteString("event: content_block_stop\n")
 		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
-		blockIndex++
 		flusher.Flush()
+		blockIndex++
+		textBlockStarted = false
 	}
 
-	// 标记是否已发送文本块开始
-	textBlockStarted := false
-
-	svc := client.GetService()
-	err := svc.SendStreamRequestWithIP(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
-
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
+	// 思考块结束时发送整段思考内容的签名
+	thinkingBlockStarted := false
+	var thinkingText strings.Builder
+	closeThinkingBlock := func() {
+		if !thinkingBlockStarted {
+			return
 		}
+		signatureJSON, _ := json.Marshal(thinkingSignature(thinkingText.String()))
+		_, _ = c.Writer.WriteString("event: content_block_delta\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"signature_delta","signature":%s}}`+"\n\n", blockIndex, signatureJSON)
+		_, _ = c.Writer.WriteString("event: content_block_stop\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+		flusher.Flush()
+		blockIndex++
+		thinkingBlockStarted = false
+		thinkingText.Reset()
+	}
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" {
-				continue
-			}
-
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
-				continue
+	var onReasoning func(text string)
+	if thinking {
+		onReasoning = func(text string) {
+			if !thinkingBlockStarted {
+				closeTextBlock()
+				_, _ = c.Writer.WriteString("event: content_block_start\n")
+				_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"thinking","thinking":""}}`+"\n\n", blockIndex)
+				thinkingBlockStarted = true
 			}
+			thinkingText.WriteString(text)
+			textJSON, _ := json.Marshal(text)
+			_, _ = c.Writer.WriteString("event: content_block_delta\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"thinking_delta","thinking":%s}}`+"\n\n", blockIndex, string(textJSON))
+			flusher.Flush()
+		}
+	}
 
-			if event.Type == "text-delta" && event.Delta != "" {
-				fullResponse.WriteString(event.Delta)
-
-				// 实时发送文本块
-				if !textBlockStarted {
-					_, _ = c.Writer.WriteString("event: content_block_start\n")
-					_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"text","text":""}}`+"\n\n", blockIndex)
-					textBlockStarted = true
-				}
-
-				textJSON, _ := json.Marshal(event.Delta)
-				_, _ = c.Writer.WriteString("event: content_block_delta\n")
-				_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%s}}`+"\n\n", blockIndex, string(textJSON))
-				flusher.Flush()
+	onText := func(text string) {
+		// 实时发送文本块
+		if !textBlockStarted {
+			if strings.TrimSpace(text) == "" {
+				pendingSpace += text
+				return
 			}
+			text = pendingSpace + text
+			pendingSpace = ""
+			closeThinkingBlock()
+			_, _ = c.Writer.WriteString("event: content_block_start\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"text","text":""}}`+"\n\n", blockIndex)
+			textBlockStarted = true
 		}
-	}, clientIP)
 
-	if err != nil {
-		_, _ = c.Writer.WriteString("event: error\n")
-		_, _ = c.Writer.WriteString(`data: {"type":"error","error":{"message":"` + err.Error() + `"}}` + "\n\n")
+		textJSON, _ := json.Marshal(text)
+		_, _ = c.Writer.WriteString("event: content_block_delta\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%s}}`+"\n\n", blockIndex, string(textJSON))
 		flusher.Flush()
-		return
 	}
 
-	// 结束文本块
-	if textBlockStarted {
+	// 工具调用解析完成后立即发送 tool_use 块
+	onToolCall := func(call toolify.ToolCall) {
+		closeThinkingBlock()
+		closeTextBlock()
+		pendingSpace = ""
+
+		toolID := "toolu_" + call.ID
+		nameJSON, _ := json.Marshal(call.Function.Name)
+		partialJSON, _ := json.Marshal(call.Function.Arguments)
+
+		_, _ = c.Writer.WriteString("event: content_block_start\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"%s","name":%s,"input":{}}}`+"\n\n", blockIndex, toolID, nameJSON)
+		_, _ = c.Writer.WriteString("event: content_block_delta\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":%s}}`+"\n\n", blockIndex, string(partialJSON))
 		_, _ = c.Writer.WriteString("event: content_block_stop\n")
 		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
-		flusher.Flush()
 		blockIndex++
+		flusher.Flush()
 	}
 
-	// 解析完整响应检查工具调用
-	responseText := fullResponse.String()
-	toolCalls, _ := toolify.ParseToolCalls(responseText)
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{OnText: onText, OnToolCall: onToolCall, OnReasoning: onReasoning})
+	if client.IsCanceled(err) {
+		log.Info("[Anthropic] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		errJSON, _ := json.Marshal(anthropicErrorBody(err))
+		_, _ = c.Writer.WriteString("event: error\n")
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", errJSON)
+		flusher.Flush()
+		return
+	}
+	closeThinkingBlock()
+	closeTextBlock()
 
-	// 发送工具调用
-	stopReason := "end_turn"
-	if len(toolCalls) > 0 {
-		stopReason = "tool_use"
-		for _, call := range toolCalls {
-			sendToolCall(call.Function.Name, call.Function.Arguments)
-		}
+	stopReason, stopSequence := anthropicStopReason(result)
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Anthropic] 检测到工具调用: %d 个", len(result.ToolCalls))
 	}
 
+	stopSequenceJSON, _ := json.Marshal(stopSequence)
 	_, _ = c.Writer.WriteString("event: message_delta\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_delta","delta":{"stop_reason":"%s","stop_sequence":null},"usage":{"output_tokens":100}}`+"\n\n", stopReason)
+	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_delta","delta":{"stop_reason":"%s","stop_sequence":%s},"usage":{"output_tokens":%d}}`+"\n\n", stopReason, stopSequenceJSON, result.OutputTokens)
 	_, _ = c.Writer.WriteString("event: message_stop\n")
 	_, _ = c.Writer.WriteString(`data: {"type":"message_stop"}` + "\n\n")
 	flusher.Flush()
 }
 
 // handleNonStream 处理非流式请求
-func handleNonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
-	svc := client.GetService()
-	result, err := svc.SendRequestWithIP(cursorReq, clientIP)
+func handleNonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, opts generateOptions, thinking bool) {
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+	if client.IsCanceled(err) {
+		log.Info("[Anthropic] 客户端已断开连接，已取消上游请求")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
+		c.JSON(errorStatus(err), anthropicErrorBody(err))
 		return
 	}
 
-	// 解析响应
-	var fullText strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" {
-			continue
-		}
-
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
-
-		if event.Type == "text-delta" && event.Delta != "" {
-			fullText.WriteString(event.Delta)
-		}
+	var contentBlocks []ContentBlock
+	if thinking && result.Reasoning != "" {
+		contentBlocks = append(contentBlocks, ContentBlock{
+			Type:      "thinking",
+			Thinking:  result.Reasoning,
+			Signature: thinkingSignature(result.Reasoning),
+		})
+	}
+	if result.Text != "" || len(result.ToolCalls) == 0 {
+		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: result.Text})
 	}
 
-	responseText := fullText.String()
-	var contentBlocks []ContentBlock
-	stopReason := "end_turn"
-
-	// 检测工具调用
-	if len(tools) > 0 {
-		toolCalls, cleanText := toolify.ParseToolCalls(responseText)
-		if len(toolCalls) > 0 {
-			stopReason = "tool_use"
-			if cleanText != "" {
-				contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: cleanText})
-			}
-			for _, call := range toolCalls {
-				var args map[string]any
-				_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
-				contentBlocks = append(contentBlocks, ContentBlock{
-					Type:  "tool_use",
-					ID:    "toolu_" + call.ID,
-					Name:  call.Function.Name,
-					Input: args,
-				})
-			}
-		} else {
-			contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
+	// 工具调用
+	if len(result.ToolCalls) > 0 {
+		for _, call := range result.ToolCalls {
+			var args map[string]any
+			_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
+			contentBlocks = append(contentBlocks, ContentBlock{
+				Type:  "tool_use",
+				ID:    "toolu_" + call.ID,
+				Name:  call.Function.Name,
+				Input: args,
+			})
 		}
-	} else {
-		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
 	}
 
+	stopReason, stopSequence := anthropicStopReason(result)
 	c.JSON(http.StatusOK, MessagesResponse{
-		ID:         "msg_" + generateID(),
-		Type:       "message",
-		Role:       "assistant",
-		Content:    contentBlocks,
-		Model:      model,
-		StopReason: stopReason,
-		Usage:      Usage{InputTokens: 100, OutputTokens: 100},
+		ID:           "msg_" + generateID(),
+		Type:         "message",
+		Role:         "assistant",
+		Content:      contentBlocks,
+		Model:        model,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        Usage{InputTokens: countInputTokens(cursorReq), OutputTokens: result.OutputTokens},
 	})
 }
+
+// anthropicStopReason 根据生成结果返回 stop_reason 和命中的停止序列
+func anthropicStopReason(result *generateResult) (string, *string) {
+	switch {
+	case result.StopSequence != "":
+		return "stop_sequence", &result.StopSequence
+	case result.MaxTokensReached:
+		return "max_tokens", nil
+	case len(result.ToolCalls) > 0:
+		return "tool_use", nil
+	}
+	return "end_turn", nil
+}
+
+// anthropicErrorBody 构建 Anthropic 格式的错误响应体
+func anthropicErrorBody(err error) gin.H {
+	errType := "api_error"
+	switch e := err.(type) {
+	case *toolValidationError:
+		return gin.H{"type": "error", "error": gin.H{
+			"type":    "tool_validation_error",
+			"message": e.Error(),
+			"details": e.Errors,
+		}}
+	case *toolify.ChoiceError:
+		return gin.H{"type": "error", "error": gin.H{"type": "tool_choice_error", "message": e.Error()}}
+	case *models.UnknownModelError:
+		errType = "not_found_error"
+	case *models.CapabilityError:
+		errType = "invalid_request_error"
+	case *auth.AuthenticationError:
+		errType = "authentication_error"
+	case *auth.PermissionError:
+		errType = "permission_error"
+	case *ratelimit.LimitError:
+		errType = "rate_limit_error"
+	}
+	return gin.H{"type": "error", "error": gin.H{"type": errType, "message": err.Error()}}
+}
@@ -0,0 +1,258 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含 OpenAI 旧版 Completions API 兼容的处理函数
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文本补全没有对话上下文，用系统提示词要求模型只输出续写内容
+const (
+	completionPrompt = "You are a text completion engine. Continue the text provided by the user exactly where it ends. " +
+		"Output only the continuation: do not repeat the given text, do not add explanations, and do not wrap the output in code fences."
+	insertionPrompt = "You are a text completion engine. The user provides the text before (<prefix>) and after (<suffix>) a gap. " +
+		"Output only the text that belongs in the gap: do not repeat the prefix or suffix, do not add explanations, and do not wrap the output in code fences."
+)
+
+// maxPrompts prompt 数组的最大长度
+// 每个 prompt 都会单独请求一次上游，但整个请求只占用一次限流配额，需要限制数量
+const maxPrompts = 4
+
+// defaultCompletionMaxTokens 未指定 max_tokens 时每个 prompt 最多输出的 token 数，与 OpenAI 的默认值一致
+const defaultCompletionMaxTokens = 16
+
+// CompletionRequest OpenAI Completions 请求格式
+type CompletionRequest struct {
+	Model string `json:"model"`
+	// Prompt 字符串或字符串数组，数组中的每个 prompt 对应一个 choice
+	Prompt      interface{} `json:"prompt"`
+	Suffix      string      `json:"suffix,omitempty"`
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature float64     `json:"temperature,omitempty"`
+	// Stop 字符串或字符串数组
+	Stop          interface{}    `json:"stop,omitempty"`
+	Echo          bool           `json:"echo,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// CompletionResponse Completions 响应格式，流式响应的每个分块也使用该格式
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *OpenAIUsage       `json:"usage,omitempty"`
+}
+
+// CompletionChoice 补全结果
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// Completions 处理 OpenAI Completions API 请求
+func Completions(c *gin.Context) {
+	var req CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+
+	prompts, err := parsePrompts(req.Prompt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "prompt"}})
+		return
+	}
+	log.Info("[Completions] 请求: 模型=%s, prompt 数=%d, 流式=%v, suffix=%v", req.Model, len(prompts), req.Stream, req.Suffix != "")
+
+	model, err := resolveModel(c, req.Model, models.Capabilities{})
+	if err != nil {
+		log.Warn("[Completions] %v", err)
+		c.JSON(errorStatus(err), openAIErrorBody(err))
+		return
+	}
+
+	cursorReqs := make([]client.CursorChatRequest, len(prompts))
+	for i, prompt := range prompts {
+		cursorReqs[i] = convertCompletionToCursor(prompt, req.Suffix, model.Upstream)
+	}
+
+	maxTokens := req.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultCompletionMaxTokens
+	}
+	opts := generateOptions{
+		ClientIP:  getClientIP(c),
+		Model:     c.GetString(modelContextKey),
+		Stop:      parseStopSequences(req.Stop),
+		MaxTokens: maxOutputTokens(maxTokens, model),
+	}
+
+	if req.Stream {
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		handleCompletionStream(c, req, prompts, cursorReqs, opts, includeUsage)
+	} else {
+		handleCompletionNonStream(c, req, prompts, cursorReqs, opts)
+	}
+}
+
+// parsePrompts 解析 prompt，支持字符串和字符串数组，不支持 token 数组
+func parsePrompts(v interface{}) ([]string, error) {
+	switch p := v.(type) {
+	case string:
+		return []string{p}, nil
+	case []interface{}:
+		if len(p) == 0 {
+			return nil, fmt.Errorf("prompt must not be empty")
+		}
+		if len(p) > maxPrompts {
+			return nil, fmt.Errorf("prompt array must contain at most %d prompts, got %d", maxPrompts, len(p))
+		}
+		prompts := make([]string, len(p))
+		for i, item := range p {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("prompt must be a string or an array of strings, token arrays are not supported")
+			}
+			prompts[i] = s
+		}
+		return prompts, nil
+	case nil:
+		return []string{""}, nil
+	}
+	return nil, fmt.Errorf("prompt must be a string or an array of strings")
+}
+
+// convertCompletionToCursor 将 prompt 包装为对话请求，有 suffix 时要求模型填充中间内容
+func convertCompletionToCursor(prompt, suffix, upstreamModel string) client.CursorChatRequest {
+	system, user := completionPrompt, prompt
+	if suffix != "" {
+		system = insertionPrompt
+		user = "<prefix>" + prompt + "</prefix>\n<suffix>" + suffix + "</suffix>"
+	}
+	return client.CursorChatRequest{
+		Model: upstreamModel,
+		ID:    generateID(),
+		Messages: []client.CursorMessage{
+			{Parts: []client.CursorPart{{Type: "text", Text: system}}, ID: generateID(), Role: "system"},
+			{Parts: []client.CursorPart{{Type: "text", Text: user}}, ID: generateID(), Role: "user"},
+		},
+		Trigger: "submit-message",
+	}
+}
+
+// handleCompletionStream 处理流式请求，多个 prompt 依次生成，按 index 区分
+func handleCompletionStream(c *gin.Context, req CompletionRequest, prompts []string, cursorReqs []client.CursorChatRequest, opts generateOptions, includeUsage bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
+	id := "cmpl-" + generateID()
+	created := time.Now().Unix()
+	flusher, _ := c.Writer.(http.Flusher)
+
+	sendChunk := func(index int, text string, finishReason *string) {
+		chunk := CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []CompletionChoice{{Text: text, Index: index, FinishReason: finishReason}},
+		}
+		chunkJSON, _ := json.Marshal(chunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
+		flusher.Flush()
+	}
+
+	promptTokens, completionTokens := 0, 0
+	for i, cursorReq := range cursorReqs {
+		index := i
+		if req.Echo && prompts[i] != "" {
+			sendChunk(index, prompts[i], nil)
+		}
+		result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{
+			OnText: func(text string) { sendChunk(index, text, nil) },
+		})
+		if client.IsCanceled(err) {
+			log.Info("[Completions] 客户端已断开连接，已取消上游请求")
+			return
+		}
+		if err != nil {
+			errJSON, _ := json.Marshal(openAIErrorBody(err))
+			_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", errJSON)
+			_, _ = c.Writer.WriteString("data: [DONE]\n\n")
+			flusher.Flush()
+			return
+		}
+		reason := openAIFinishReason(result, false)
+		sendChunk(index, "", &reason)
+		promptTokens += countInputTokens(cursorReq)
+		completionTokens += result.OutputTokens
+	}
+
+	if includeUsage {
+		usageChunk := CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []CompletionChoice{},
+			Usage:   newOpenAIUsage(promptTokens, completionTokens),
+		}
+		usageJSON, _ := json.Marshal(usageChunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", usageJSON)
+	}
+	_, _ = c.Writer.WriteString("data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// handleCompletionNonStream 处理非流式请求
+func handleCompletionNonStream(c *gin.Context, req CompletionRequest, prompts []string, cursorReqs []client.CursorChatRequest, opts generateOptions) {
+	choices := make([]CompletionChoice, 0, len(cursorReqs))
+	promptTokens, completionTokens := 0, 0
+	for i, cursorReq := range cursorReqs {
+		result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+		if client.IsCanceled(err) {
+			log.Info("[Completions] 客户端已断开连接，已取消上游请求")
+			return
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), openAIErrorBody(err))
+			return
+		}
+
+		text := result.Text
+		if req.Echo {
+			text = prompts[i] + text
+		}
+		reason := openAIFinishReason(result, false)
+		choices = append(choices, CompletionChoice{Text: text, Index: i, FinishReason: &reason})
+		promptTokens += countInputTokens(cursorReq)
+		completionTokens += result.OutputTokens
+	}
+
+	c.JSON(http.StatusOK, CompletionResponse{
+		ID:      "cmpl-" + generateID(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: choices,
+		Usage:   newOpenAIUsage(promptTokens, completionTokens),
+	})
+}
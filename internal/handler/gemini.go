@@ -0,0 +1,531 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含 Google Gemini generateContent API 兼容的处理函数
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ================== 请求/响应结构体 ==================
+
+// GeminiRequest Gemini generateContent 请求格式（字段使用 camelCase）
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// GeminiContent 一轮对话内容，role 为 user 或 model
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+// GeminiPart 内容片段，每个片段只设置其中一个字段
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *GeminiBlob             `json:"inlineData,omitempty"`
+	FileData         *GeminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// GeminiBlob base64 编码的内联数据
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// GeminiFileData 通过 URI 引用的文件
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+// GeminiFunctionCall 模型发起的函数调用
+type GeminiFunctionCall struct {
+	ID   string                 `json:"id,omitempty"`
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args"`
+}
+
+// GeminiFunctionResponse 函数执行结果
+type GeminiFunctionResponse struct {
+	ID       string                 `json:"id,omitempty"`
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+// GeminiTool 工具定义，只支持 functionDeclarations
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+// GeminiFunctionDeclaration 函数声明，parameters 为 OpenAPI schema，parametersJsonSchema 为 JSON Schema
+type GeminiFunctionDeclaration struct {
+	Name                 string                 `json:"name"`
+	Description          string                 `json:"description,omitempty"`
+	Parameters           map[string]interface{} `json:"parameters,omitempty"`
+	ParametersJSONSchema map[string]interface{} `json:"parametersJsonSchema,omitempty"`
+}
+
+// GeminiToolConfig 工具调用配置
+type GeminiToolConfig struct {
+	FunctionCallingConfig *struct {
+		// Mode AUTO / ANY / NONE / VALIDATED
+		Mode string `json:"mode"`
+		// AllowedFunctionNames 只允许调用这些函数，只有一个时要求调用该函数
+		AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+	} `json:"functionCallingConfig,omitempty"`
+}
+
+// GeminiGenerationConfig 生成参数
+type GeminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+// GeminiResponse generateContent 响应格式，流式响应的每个分块也使用该格式
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate `json:"candidates"`
+	UsageMetadata *GeminiUsage      `json:"usageMetadata,omitempty"`
+	ModelVersion  string            `json:"modelVersion,omitempty"`
+}
+
+// GeminiCandidate 候选回复
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+// GeminiUsage token 使用统计
+type GeminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// ================== 处理器函数 ==================
+
+// Gemini 处理 /v1beta/models/{model}:{method} 请求
+func Gemini(c *gin.Context) {
+	name, method, ok := strings.Cut(c.Param("action"), ":")
+	if !ok {
+		c.JSON(http.StatusNotFound, geminiError(http.StatusNotFound, fmt.Sprintf("method not found: %s", c.Param("action"))))
+		return
+	}
+
+	switch method {
+	case "generateContent":
+		geminiGenerate(c, name, false)
+	case "streamGenerateContent":
+		geminiGenerate(c, name, true)
+	case "countTokens":
+		geminiCountTokens(c)
+	default:
+		c.JSON(http.StatusNotFound, geminiError(http.StatusNotFound, fmt.Sprintf("method not supported: %s", method)))
+	}
+}
+
+// geminiGenerate 处理 generateContent / streamGenerateContent
+func geminiGenerate(c *gin.Context, name string, stream bool) {
+	var req GeminiRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, geminiError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	msgReq, err := convertGeminiToMessages(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, geminiError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	log.Info("[Gemini] 请求: 模型=%s, 消息数=%d, 流式=%v, 工具数=%d", name, len(msgReq.Messages), stream, len(msgReq.Tools))
+
+	required := models.Capabilities{Tools: len(msgReq.Tools) > 0, Vision: hasImageBlocks(msgReq)}
+	model, err := resolveModel(c, name, required)
+	if err != nil {
+		log.Warn("[Gemini] %v", err)
+		c.JSON(errorStatus(err), geminiErrorBody(err))
+		return
+	}
+
+	cursorReq := convertToCursor(msgReq, model.Upstream)
+	opts := generateOptions{
+		Tools:      msgReq.Tools,
+		ClientIP:   getClientIP(c),
+		Model:      c.GetString(modelContextKey),
+		ToolChoice: msgReq.ToolChoice.toolChoice(),
+	}
+	maxTokens := 0
+	if req.GenerationConfig != nil {
+		opts.Stop = req.GenerationConfig.StopSequences
+		maxTokens = req.GenerationConfig.MaxOutputTokens
+	}
+	opts.MaxTokens = maxOutputTokens(maxTokens, model)
+
+	if stream {
+		handleGeminiStream(c, cursorReq, name, opts)
+	} else {
+		handleGeminiNonStream(c, cursorReq, name, opts)
+	}
+}
+
+// geminiCountTokens 处理 countTokens，请求为 contents 或完整的 generateContentRequest
+func geminiCountTokens(c *gin.Context) {
+	var req struct {
+		GeminiRequest
+		GenerateContentRequest *GeminiRequest `json:"generateContentRequest,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, geminiError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	genReq := req.GeminiRequest
+	if req.GenerateContentRequest != nil {
+		genReq = *req.GenerateContentRequest
+	}
+
+	msgReq, err := convertGeminiToMessages(genReq)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, geminiError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	tokens := countInputTokens(convertToCursor(msgReq, ""))
+	c.JSON(http.StatusOK, gin.H{"totalTokens": tokens})
+}
+
+// ================== 请求转换 ==================
+
+// convertGeminiToMessages 将 Gemini 请求转换为 Anthropic 格式，复用 convertToCursor 的转换逻辑
+// 函数调用转换为 tool_use，函数结果转换为 tool_result，调用 ID 缺失时使用函数名
+// toolConfig 转换为 tool_choice，配置无效时返回错误
+func convertGeminiToMessages(req GeminiRequest) (MessagesRequest, error) {
+	var msgReq MessagesRequest
+	if req.SystemInstruction != nil {
+		var texts []string
+		for _, part := range req.SystemInstruction.Parts {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+		msgReq.System = strings.Join(texts, "\n")
+	}
+
+	for _, content := range req.Contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		blocks := make([]interface{}, 0, len(content.Parts))
+		for _, part := range content.Parts {
+			switch {
+			case part.Text != "":
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": part.Text})
+			case part.InlineData != nil:
+				blocks = append(blocks, map[string]interface{}{"type": "image", "source": map[string]interface{}{
+					"type":       "base64",
+					"media_type": part.InlineData.MimeType,
+					"data":       part.InlineData.Data,
+				}})
+			case part.FileData != nil:
+				blocks = append(blocks, map[string]interface{}{"type": "image", "source": map[string]interface{}{
+					"type":       "url",
+					"media_type": part.FileData.MimeType,
+					"url":        part.FileData.FileURI,
+				}})
+			case part.FunctionCall != nil:
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"name":  part.FunctionCall.Name,
+					"input": part.FunctionCall.Args,
+				})
+			case part.FunctionResponse != nil:
+				id := part.FunctionResponse.ID
+				if id == "" {
+					id = part.FunctionResponse.Name
+				}
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				blocks = append(blocks, map[string]interface{}{
+					"type":        "tool_result",
+					"tool_use_id": id,
+					"content":     string(response),
+				})
+			}
+		}
+		msgReq.Messages = append(msgReq.Messages, Message{Role: role, Content: blocks})
+	}
+
+	mode := ""
+	var allowed []string
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil {
+		mode = strings.ToUpper(req.ToolConfig.FunctionCallingConfig.Mode)
+		allowed = req.ToolConfig.FunctionCallingConfig.AllowedFunctionNames
+	}
+	switch mode {
+	case "", "MODE_UNSPECIFIED", "AUTO", "VALIDATED", "ANY":
+	case "NONE":
+		log.Debug("[Gemini] functionCallingConfig.mode=NONE, 不注入工具")
+		return msgReq, nil
+	default:
+		return msgReq, fmt.Errorf("unsupported functionCallingConfig.mode: %s", mode)
+	}
+	for _, tool := range req.Tools {
+		for _, fn := range tool.FunctionDeclarations {
+			schema := fn.ParametersJSONSchema
+			if schema == nil {
+				schema = normalizeGeminiSchema(fn.Parameters)
+			}
+			msgReq.Tools = append(msgReq.Tools, toolify.ToolDefinition{
+				Name:        fn.Name,
+				Description: fn.Description,
+				InputSchema: schema,
+			})
+		}
+	}
+
+	// allowedFunctionNames 只注入允许的函数
+	if len(allowed) > 0 {
+		tools := make([]toolify.ToolDefinition, 0, len(allowed))
+		seen := make(map[string]bool, len(allowed))
+		for _, name := range allowed {
+			tool, ok := toolify.FindTool(name, msgReq.Tools)
+			if !ok {
+				return msgReq, fmt.Errorf("allowedFunctionNames: function '%s' is not declared in tools", name)
+			}
+			if !seen[tool.GetName()] {
+				seen[tool.GetName()] = true
+				tools = append(tools, tool)
+			}
+		}
+		msgReq.Tools = tools
+	}
+	if mode == "ANY" {
+		if len(msgReq.Tools) == 0 {
+			return msgReq, fmt.Errorf("functionCallingConfig.mode ANY requires at least one function declaration")
+		}
+		// 只允许一个函数时要求调用该函数，否则要求至少调用一个
+		msgReq.ToolChoice = &AnthropicToolChoice{Type: "any"}
+		if len(msgReq.Tools) == 1 {
+			msgReq.ToolChoice = &AnthropicToolChoice{Type: "tool", Name: msgReq.Tools[0].GetName()}
+		}
+	}
+	return msgReq, nil
+}
+
+// normalizeGeminiSchema 将 OpenAPI schema 中大写的类型名（OBJECT、STRING 等）转换为 JSON Schema 的小写形式
+func normalizeGeminiSchema(schema map[string]interface{}) map[string]interface{} {
+	if schema == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(schema))
+	for key, value := range schema {
+		switch v := value.(type) {
+		case string:
+			if key == "type" {
+				v = strings.ToLower(v)
+			}
+			result[key] = v
+		case map[string]interface{}:
+			if key == "properties" {
+				props := make(map[string]interface{}, len(v))
+				for name, prop := range v {
+					if p, ok := prop.(map[string]interface{}); ok {
+						props[name] = normalizeGeminiSchema(p)
+					} else {
+						props[name] = prop
+					}
+				}
+				result[key] = props
+			} else {
+				result[key] = normalizeGeminiSchema(v)
+			}
+		case []interface{}:
+			items := make([]interface{}, len(v))
+			for i, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					items[i] = normalizeGeminiSchema(m)
+				} else {
+					items[i] = item
+				}
+			}
+			result[key] = items
+		default:
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ================== API 处理 ==================
+
+// geminiFunctionCallPart 将工具调用转换为 functionCall 片段
+func geminiFunctionCallPart(call toolify.ToolCall) GeminiPart {
+	var args map[string]interface{}
+	_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
+	return GeminiPart{FunctionCall: &GeminiFunctionCall{Name: call.Function.Name, Args: args}}
+}
+
+// newGeminiResponse 创建只有一个候选的响应
+func newGeminiResponse(model string, parts []GeminiPart, finishReason string) GeminiResponse {
+	return GeminiResponse{
+		Candidates: []GeminiCandidate{{
+			Content:      GeminiContent{Role: "model", Parts: parts},
+			FinishReason: finishReason,
+		}},
+		ModelVersion: model,
+	}
+}
+
+// handleGeminiStream 处理流式请求
+// 请求带 alt=sse 时按 SSE 输出，否则按 Gemini 默认的 JSON 数组逐个输出分块
+func handleGeminiStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, opts generateOptions) {
+	sse := c.Query("alt") == "sse"
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
+	flusher, _ := c.Writer.(http.Flusher)
+	chunks := 0
+	writeChunk := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		if sse {
+			_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		} else {
+			sep := ",\r\n"
+			if chunks == 0 {
+				sep = "["
+			}
+			_, _ = c.Writer.WriteString(sep)
+			_, _ = c.Writer.Write(data)
+		}
+		chunks++
+		flusher.Flush()
+	}
+	closeStream := func() {
+		if !sse {
+			if chunks == 0 {
+				_, _ = c.Writer.WriteString("[")
+			}
+			_, _ = c.Writer.WriteString("]")
+		}
+		flusher.Flush()
+	}
+
+	onText := func(text string) {
+		writeChunk(newGeminiResponse(model, []GeminiPart{{Text: text}}, ""))
+	}
+	onToolCall := func(call toolify.ToolCall) {
+		writeChunk(newGeminiResponse(model, []GeminiPart{geminiFunctionCallPart(call)}, ""))
+	}
+
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{OnText: onText, OnToolCall: onToolCall})
+	if client.IsCanceled(err) {
+		log.Info("[Gemini] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		writeChunk(geminiErrorBody(err))
+		closeStream()
+		return
+	}
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Gemini] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
+
+	end := newGeminiResponse(model, []GeminiPart{}, geminiFinishReason(result))
+	end.UsageMetadata = newGeminiUsage(countInputTokens(cursorReq), result.OutputTokens)
+	writeChunk(end)
+	closeStream()
+}
+
+// handleGeminiNonStream 处理非流式请求
+func handleGeminiNonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, opts generateOptions) {
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+	if client.IsCanceled(err) {
+		log.Info("[Gemini] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), geminiErrorBody(err))
+		return
+	}
+
+	parts := make([]GeminiPart, 0, len(result.ToolCalls)+1)
+	if result.Text != "" || len(result.ToolCalls) == 0 {
+		parts = append(parts, GeminiPart{Text: result.Text})
+	}
+	for _, call := range result.ToolCalls {
+		parts = append(parts, geminiFunctionCallPart(call))
+	}
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Gemini] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
+
+	resp := newGeminiResponse(model, parts, geminiFinishReason(result))
+	resp.UsageMetadata = newGeminiUsage(countInputTokens(cursorReq), result.OutputTokens)
+	c.JSON(http.StatusOK, resp)
+}
+
+// geminiFinishReason 根据生成结果返回 finishReason
+func geminiFinishReason(result *generateResult) string {
+	if result.MaxTokensReached {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
+
+// newGeminiUsage 创建 usageMetadata，total 为两者之和
+func newGeminiUsage(prompt, candidates int) *GeminiUsage {
+	return &GeminiUsage{PromptTokenCount: prompt, CandidatesTokenCount: candidates, TotalTokenCount: prompt + candidates}
+}
+
+// geminiStatus HTTP 状态码对应的 Google API 错误状态
+var geminiStatus = map[int]string{
+	http.StatusBadRequest:         "INVALID_ARGUMENT",
+	http.StatusUnauthorized:       "UNAUTHENTICATED",
+	http.StatusForbidden:          "PERMISSION_DENIED",
+	http.StatusNotFound:           "NOT_FOUND",
+	http.StatusTooManyRequests:    "RESOURCE_EXHAUSTED",
+	http.StatusServiceUnavailable: "UNAVAILABLE",
+}
+
+// geminiError 构建 Google API 格式的错误响应体
+func geminiError(code int, message string) gin.H {
+	status, ok := geminiStatus[code]
+	if !ok {
+		status = "INTERNAL"
+	}
+	return gin.H{"error": gin.H{"code": code, "message": message, "status": status}}
+}
+
+// geminiErrorBody 构建 Gemini 格式的错误响应体
+func geminiErrorBody(err error) gin.H {
+	body := geminiError(errorStatus(err), err.Error())
+	if e, ok := err.(*toolValidationError); ok {
+		body["error"].(gin.H)["details"] = e.Errors
+	}
+	return body
+}
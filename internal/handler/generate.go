@@ -0,0 +1,474 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含各协议共用的生成流程
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cursor2api/internal/auth"
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/ratelimit"
+	"cursor2api/internal/sse"
+	"cursor2api/internal/tokenizer"
+	"cursor2api/internal/toolify"
+)
+
+// generateOptions 生成参数
+type generateOptions struct {
+	Tools    []toolify.ToolDefinition
+	ClientIP string
+	// Model 模型统计标签
+	Model string
+	// Stop 停止序列，文本中出现任意一个时截断输出并中止上游请求
+	Stop []string
+	// MaxTokens 最多输出的 token 数，0 表示不限制
+	MaxTokens int
+	// ReturnReasoning 推理内容会返回给客户端，为 true 时推理内容计入 MaxTokens 和 OutputTokens，
+	// 否则客户端看不到推理内容，不占用输出额度
+	ReturnReasoning bool
+	// ReasoningBudget 推理内容最多输出的 token 数（Anthropic thinking.budget_tokens），
+	// 超出部分丢弃且不计入输出 token，上游继续生成回复正文；0 表示不限制
+	ReasoningBudget int
+	// ToolChoice 工具调用约束，要求调用工具但模型未调用时按 tool_validation 配置重试或返回 *toolify.ChoiceError
+	// 指定了工具时对其他工具的调用直接丢弃，不会输出给客户端，也不会带到重试中
+	ToolChoice toolify.ToolChoice
+}
+
+// generateCallbacks 流式输出回调，非流式请求传零值即可
+type generateCallbacks struct {
+	// OnText 收到文本增量时回调，工具调用标签不会出现在文本中
+	OnText func(text string)
+	// OnToolCall 每个工具调用完整解析并通过校验后立即回调
+	OnToolCall func(call toolify.ToolCall)
+	// OnReasoning 收到上游推理（思考）内容增量时回调
+	OnReasoning func(text string)
+}
+
+// generateResult 生成结果
+type generateResult struct {
+	// Text 回复文本（已去除工具调用标记）
+	Text string
+	// Reasoning 上游返回的推理内容
+	Reasoning string
+	// ToolCalls 校验通过的工具调用
+	ToolCalls []toolify.ToolCall
+	// OutputTokens 被接受的那次尝试中上游输出的 token 数（包括返回给客户端的推理内容和工具调用标记），
+	// 纠正重试中被丢弃的输出不计入
+	OutputTokens int
+	// StopSequence 命中的停止序列，未命中时为空
+	StopSequence string
+	// MaxTokensReached 输出达到 MaxTokens 后被截断
+	MaxTokensReached bool
+}
+
+// toolValidationError 工具调用参数校验失败（error 模式或 reprompt 重试用尽）
+type toolValidationError struct {
+	Errors []*toolify.ValidationError
+}
+
+func (e *toolValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// generate 发送请求并汇总响应
+// 有工具时边接收边识别工具调用：标签内容不作为文本输出，每个调用完成后立即按客户端
+// 提供的 schema 校验修正并回调 OnToolCall；校验失败的调用按 tool_validation 配置
+// 要求模型重新输出，或返回 *toolValidationError
+// 重新输出时文本和推理内容只保留最后一次的结果；之前已通过校验的工具调用会保留
+// （纠正提示要求模型不要重复），模型重复输出的相同调用会被忽略
+// 还可能重新输出时，本次尝试的回调先缓存，确认不需要重试后再按顺序执行，
+// 避免流式客户端收到被拒绝的那次输出
+// 设置了停止序列时，文本中出现停止序列即截断输出并中止上游请求
+func generate(ctx context.Context, req client.CursorChatRequest, opts generateOptions, cb generateCallbacks) (*generateResult, error) {
+	validation := config.Get().ToolValidation
+	retries := 0
+	if validation.Mode == "reprompt" {
+		retries = validation.MaxRetries
+	}
+
+	// 命中停止序列时取消上游请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := &generateResult{}
+	var text, reasoning strings.Builder
+
+	// 按 token 数限制上游输出（包括返回给客户端的推理内容和工具调用标记），达到上限时截断并中止上游请求
+	// 按累计的输出计数，逐个分片计数再相加会多算；每次尝试重新计数，被丢弃的输出不占用额度
+	var used tokenizer.Counter
+	limit := func(delta string) string {
+		if opts.MaxTokens <= 0 {
+			return delta
+		}
+		if result.MaxTokensReached {
+			return ""
+		}
+		delta, truncated := used.AddLimited(delta, opts.MaxTokens)
+		if truncated {
+			result.MaxTokensReached = true
+			cancel()
+		}
+		return delta
+	}
+
+	// hold 为 true 时回调缓存到 held，本次尝试被接受后再执行
+	hold := false
+	var held []heldCallback
+	deliver := func(toolCall bool, f func()) {
+		if hold {
+			held = append(held, heldCallback{toolCall: toolCall, run: f})
+			return
+		}
+		f()
+	}
+	flushHeld := func() {
+		for _, h := range held {
+			h.run()
+		}
+		held = nil
+	}
+
+	stop := newStopMatcher(opts.Stop)
+	emitText := func(s string) {
+		if s == "" {
+			return
+		}
+		text.WriteString(s)
+		if cb.OnText != nil {
+			deliver(false, func() { cb.OnText(s) })
+		}
+	}
+
+	// 首个文本、推理内容或工具调用到达时记录首 token 延迟
+	start := time.Now()
+	firstToken := false
+	markFirstToken := func() {
+		if !firstToken {
+			firstToken = true
+			metrics.TimeToFirstToken.Observe(time.Since(start).Seconds(), opts.Model)
+		}
+	}
+	// 每次尝试单独计算推理预算，推理内容只保留最后一次的结果
+	var reasoningUsed tokenizer.Counter
+	reasoningCapped := false
+	onReasoning := func(delta string) {
+		if opts.ReasoningBudget > 0 {
+			if reasoningCapped {
+				return
+			}
+			delta, reasoningCapped = reasoningUsed.AddLimited(delta, opts.ReasoningBudget)
+			if reasoningCapped {
+				log.Debug("推理内容达到 budget_tokens (%d), 丢弃之后的推理内容", opts.ReasoningBudget)
+			}
+		}
+		if opts.ReturnReasoning {
+			delta = limit(delta)
+		}
+		if delta == "" {
+			return
+		}
+		markFirstToken()
+		reasoning.WriteString(delta)
+		if cb.OnReasoning != nil {
+			deliver(false, func() { cb.OnReasoning(delta) })
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var errs []*toolify.ValidationError
+		text.Reset()
+		reasoning.Reset()
+		reasoningUsed, reasoningCapped = tokenizer.Counter{}, false
+		used = tokenizer.Counter{}
+		hold = len(opts.Tools) > 0 && attempt < retries
+		if !hold {
+			// 最后一次尝试直接输出，先补上之前尝试中已接受的工具调用
+			flushHeld()
+		}
+		// 之前的尝试中已接受的工具调用
+		accepted := len(result.ToolCalls)
+		handleEvent := func(event toolify.StreamEvent) {
+			if result.StopSequence != "" {
+				// 已命中停止序列，丢弃之后的输出
+				return
+			}
+			markFirstToken()
+			if event.ToolCall == nil {
+				if stop == nil {
+					emitText(event.Text)
+					return
+				}
+				out, matched := stop.Feed(event.Text)
+				emitText(out)
+				if matched != "" {
+					result.StopSequence = matched
+					cancel()
+				}
+				return
+			}
+			if stop != nil {
+				emitText(stop.Flush())
+			}
+
+			call := *event.ToolCall
+			if !opts.ToolChoice.Allows(call.Function.Name) {
+				log.Warn("tool_choice 指定了工具 %s, 忽略对 %s 的调用", opts.ToolChoice.Name, call.Function.Name)
+				return
+			}
+			if opts.ToolChoice.DisableParallel && len(result.ToolCalls) > 0 {
+				log.Warn("已禁用并行工具调用, 忽略多余的调用: %s", call.Function.Name)
+				return
+			}
+			if validation.Mode != "off" {
+				fixed, err := toolify.ValidateToolCall(call, opts.Tools)
+				if verr, ok := err.(*toolify.ValidationError); ok {
+					metrics.ToolCalls.Inc(opts.Model, "invalid")
+					errs = append(errs, verr)
+					return
+				}
+				call = fixed
+			}
+			if hasToolCall(result.ToolCalls[:accepted], call) {
+				log.Debug("忽略重复的工具调用: %s", call.Function.Name)
+				return
+			}
+			metrics.ToolCalls.Inc(opts.Model, "ok")
+			result.ToolCalls = append(result.ToolCalls, call)
+			if cb.OnToolCall != nil {
+				deliver(true, func() { cb.OnToolCall(call) })
+			}
+		}
+
+		var parser *toolify.StreamParser
+		if len(opts.Tools) > 0 {
+			parser = toolify.NewStreamParser()
+		}
+		raw, err := generateOnce(ctx, req, opts.ClientIP, func(delta string) {
+			if delta = limit(delta); delta == "" {
+				return
+			}
+			if parser == nil {
+				handleEvent(toolify.StreamEvent{Text: delta})
+				return
+			}
+			for _, event := range parser.Feed(delta) {
+				handleEvent(event)
+			}
+		}, onReasoning)
+		stopped := result.StopSequence != "" || result.MaxTokensReached
+		if err != nil && !stopped {
+			if errors.Is(context.Cause(ctx), client.ErrShuttingDown) {
+				// 服务关闭时被取消，不按客户端断开处理，由各协议向客户端写出错误
+				return nil, client.ErrShuttingDown
+			}
+			return nil, err
+		}
+		result.Reasoning = reasoning.String()
+		result.OutputTokens = tokenizer.Count(raw)
+		if opts.ReturnReasoning {
+			result.OutputTokens += tokenizer.Count(result.Reasoning)
+		}
+		if result.MaxTokensReached {
+			// raw 包含截断位置之后已收到的内容，按实际输出计数
+			result.OutputTokens = opts.MaxTokens
+		}
+		if parser != nil && !stopped {
+			for _, event := range parser.Flush() {
+				handleEvent(event)
+			}
+		}
+		if stop != nil && result.StopSequence == "" {
+			emitText(stop.Flush())
+		}
+		if parser == nil {
+			result.Text = text.String()
+			return result, nil
+		}
+
+		var choiceErr error
+		if len(errs) == 0 {
+			choiceErr = toolify.CheckChoice(opts.ToolChoice, result.ToolCalls)
+		}
+		if (len(errs) == 0 && choiceErr == nil) || stopped {
+			result.Text = strings.TrimSpace(text.String())
+			flushHeld()
+			return result, nil
+		}
+		// 丢弃被拒绝的文本和推理内容，已接受的工具调用留到之后输出
+		held = keepToolCalls(held)
+		if choiceErr != nil {
+			if attempt >= retries {
+				log.Error("%v", choiceErr)
+				return nil, choiceErr
+			}
+			log.Warn("%v, 要求模型重新输出 (%d/%d)", choiceErr, attempt+1, retries)
+			req = withFollowUp(req, raw, toolify.ChoiceCorrectionPrompt(opts.ToolChoice))
+			continue
+		}
+		if attempt >= retries {
+			log.Error("工具调用参数校验失败: %d 个无效调用", len(errs))
+			return nil, &toolValidationError{Errors: errs}
+		}
+		log.Warn("工具调用参数校验失败, 要求模型重新输出 (%d/%d): %s", attempt+1, retries, (&toolValidationError{Errors: errs}).Error())
+		req = withFollowUp(req, raw, toolify.CorrectionPrompt(errs))
+	}
+}
+
+// heldCallback 缓存的输出回调
+type heldCallback struct {
+	// toolCall 是否为已接受的工具调用，重试时只保留这类回调
+	toolCall bool
+	run      func()
+}
+
+// keepToolCalls 只保留工具调用的回调
+func keepToolCalls(held []heldCallback) []heldCallback {
+	kept := held[:0]
+	for _, h := range held {
+		if h.toolCall {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// hasToolCall 检查 calls 中是否已有名称和参数都相同的调用
+func hasToolCall(calls []toolify.ToolCall, call toolify.ToolCall) bool {
+	for _, c := range calls {
+		if c.Function.Name == call.Function.Name && c.Function.Arguments == call.Function.Arguments {
+			return true
+		}
+	}
+	return false
+}
+
+// maxOutputTokens 返回请求的输出上限，未指定或超过模型的 max_output 时使用模型的上限
+func maxOutputTokens(requested int, model *models.Model) int {
+	if requested <= 0 || (model.MaxOutput > 0 && requested > model.MaxOutput) {
+		return model.MaxOutput
+	}
+	return requested
+}
+
+// imageTokenEstimate 每张图片估算的 token 数（约 1000x1000 像素的图片）
+const imageTokenEstimate = 1600
+
+// countInputTokens 统计发送给上游的全部消息的 token 数，
+// 包括系统提示词、注入的工具提示词和工具定义，图片按固定数量估算
+func countInputTokens(req client.CursorChatRequest) int {
+	texts := make([]string, 0, len(req.Messages))
+	images := 0
+	for _, msg := range req.Messages {
+		for _, part := range msg.Parts {
+			if part.Type == "file" {
+				images++
+				continue
+			}
+			texts = append(texts, part.Text)
+		}
+	}
+	return tokenizer.CountMessages(texts) + images*imageTokenEstimate
+}
+
+// errorStatus 返回生成失败时对应的 HTTP 状态码
+func errorStatus(err error) int {
+	if errors.Is(err, client.ErrShuttingDown) {
+		return http.StatusServiceUnavailable
+	}
+	switch err.(type) {
+	case *toolValidationError, *toolify.ChoiceError:
+		return http.StatusBadGateway
+	case *models.UnknownModelError:
+		return http.StatusNotFound
+	case *models.CapabilityError:
+		return http.StatusBadRequest
+	case *auth.AuthenticationError:
+		return http.StatusUnauthorized
+	case *auth.PermissionError:
+		return http.StatusForbidden
+	case *ratelimit.LimitError:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// sendUpstream 发送流式上游请求，测试中替换为模拟的上游
+var sendUpstream = func(ctx context.Context, req client.CursorChatRequest, onChunk func(chunk string), clientIP string) error {
+	return client.GetService().SendStreamRequestWithIP(ctx, req, onChunk, clientIP)
+}
+
+// generateOnce 发送一次上游请求，流式解码文本和推理增量并返回完整文本
+// 出错时同时返回已收到的文本
+func generateOnce(ctx context.Context, req client.CursorChatRequest, clientIP string, onDelta, onReasoning func(string)) (string, error) {
+	var fullText strings.Builder
+	upstreamErr := ""
+
+	handleEvent := func(event sse.Event) {
+		switch event.Type {
+		case sse.EventTextDelta:
+			if event.Delta == "" {
+				return
+			}
+			fullText.WriteString(event.Delta)
+			onDelta(event.Delta)
+		case sse.EventReasoningDelta:
+			if event.Delta != "" {
+				onReasoning(event.Delta)
+			}
+		case sse.EventError:
+			metrics.UpstreamErrors.Inc("event")
+			log.Error("上游返回错误事件: %s", event.Error)
+			upstreamErr = event.Error
+		}
+	}
+
+	decoder := sse.NewDecoder()
+	err := sendUpstream(ctx, req, func(chunk string) {
+		for _, event := range decoder.Feed(chunk) {
+			handleEvent(event)
+		}
+	}, clientIP)
+	for _, event := range decoder.Flush() {
+		handleEvent(event)
+	}
+	if err != nil {
+		return fullText.String(), err
+	}
+	if upstreamErr != "" {
+		return fullText.String(), fmt.Errorf("上游错误: %s", upstreamErr)
+	}
+	return fullText.String(), nil
+}
+
+// withFollowUp 在请求末尾追加模型上一次的回复和新的用户消息，用于纠正重试
+func withFollowUp(req client.CursorChatRequest, assistantText, userText string) client.CursorChatRequest {
+	messages := make([]client.CursorMessage, 0, len(req.Messages)+2)
+	messages = append(messages, req.Messages...)
+	messages = append(messages,
+		client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: assistantText}},
+			ID:    generateID(),
+			Role:  "assistant",
+		},
+		client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: userText}},
+			ID:    generateID(),
+			Role:  "user",
+		},
+	)
+	req.Messages = messages
+	req.ID = generateID()
+	return req
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/tokenizer"
+	"cursor2api/internal/toolify"
+)
+
+// fakeUpstream 模拟上游，每次请求按顺序输出 attempts 中的一组文本增量
+type fakeUpstream struct {
+	attempts [][]string
+	// reasoning 每次请求在文本之前输出的推理内容增量
+	reasoning [][]string
+	// onChunk 每个增量发送后回调，可用于检查此时客户端已收到的内容
+	onChunk func(attempt, index int)
+	// requests 收到的上游请求
+	requests []client.CursorChatRequest
+	// canceled 有请求在输出完之前被取消
+	canceled bool
+}
+
+func (f *fakeUpstream) send(ctx context.Context, req client.CursorChatRequest, onChunk func(chunk string), clientIP string) error {
+	attempt := len(f.requests)
+	f.requests = append(f.requests, req)
+	if attempt >= len(f.attempts) {
+		return fmt.Errorf("unexpected upstream request %d", attempt+1)
+	}
+	if attempt < len(f.reasoning) {
+		for _, delta := range f.reasoning[attempt] {
+			data, _ := json.Marshal(map[string]string{"type": "reasoning-delta", "delta": delta})
+			onChunk("data: " + string(data) + "\n\n")
+		}
+	}
+	for i, delta := range f.attempts[attempt] {
+		if err := ctx.Err(); err != nil {
+			f.canceled = true
+			return err
+		}
+		data, _ := json.Marshal(map[string]string{"type": "text-delta", "delta": delta})
+		onChunk("data: " + string(data) + "\n\n")
+		if f.onChunk != nil {
+			f.onChunk(attempt, i)
+		}
+	}
+	return nil
+}
+
+// useUpstream 在测试期间用 f 替换上游请求
+func useUpstream(t *testing.T, f *fakeUpstream) {
+	t.Helper()
+	orig := sendUpstream
+	sendUpstream = f.send
+	t.Cleanup(func() { sendUpstream = orig })
+}
+
+// useToolValidation 在测试期间使用指定的工具调用校验配置
+func useToolValidation(t *testing.T, mode string, retries int) {
+	t.Helper()
+	cfg := config.Get()
+	orig := cfg.ToolValidation
+	cfg.ToolValidation = config.ToolValidationConfig{Mode: mode, MaxRetries: retries}
+	t.Cleanup(func() { cfg.ToolValidation = orig })
+}
+
+// addTools 测试用的工具，n 必须是整数
+var addTools = []toolify.ToolDefinition{{
+	Name: "add",
+	InputSchema: map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"n": map[string]interface{}{"type": "integer"}},
+		"required":   []interface{}{"n"},
+	},
+}}
+
+const (
+	invalidAddCall = `<tool_call>{"name":"add","arguments":{"n":"abc"}}</tool_call>`
+	validAddCall   = `<tool_call>{"name":"add","arguments":{"n":2}}</tool_call>`
+)
+
+// generateOutput generate 的结果和各回调收到的内容
+type generateOutput struct {
+	result    *generateResult
+	err       error
+	text      string
+	toolCalls []string
+}
+
+func runGenerate(opts generateOptions) generateOutput {
+	var out generateOutput
+	var text strings.Builder
+	cb := generateCallbacks{
+		OnText: func(s string) { text.WriteString(s) },
+		OnToolCall: func(call toolify.ToolCall) {
+			out.toolCalls = append(out.toolCalls, call.Function.Name+" "+call.Function.Arguments)
+		},
+	}
+	out.result, out.err = generate(context.Background(), client.CursorChatRequest{}, opts, cb)
+	out.text = text.String()
+	return out
+}
+
+func TestGenerate(t *testing.T) {
+	cases := []struct {
+		name      string
+		attempts  [][]string
+		reasoning [][]string
+		opts      generateOptions
+		// check 检查结果，upstream 为本次使用的模拟上游
+		check func(t *testing.T, out generateOutput, upstream *fakeUpstream)
+	}{
+		{
+			name:     "reprompt succeeds",
+			attempts: [][]string{{"Adding.", invalidAddCall}, {"Adding.", validAddCall}},
+			opts:     generateOptions{Tools: addTools},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if len(upstream.requests) != 2 {
+					t.Fatalf("got %d upstream requests, want 2", len(upstream.requests))
+				}
+				last := upstream.requests[1].Messages
+				if len(last) != 2 || last[0].Role != "assistant" || last[1].Role != "user" {
+					t.Errorf("retry request does not carry the correction: %+v", last)
+				}
+				if len(out.result.ToolCalls) != 1 || len(out.toolCalls) != 1 || out.toolCalls[0] != `add {"n":2}` {
+					t.Errorf("got tool calls %v, want the corrected call once", out.toolCalls)
+				}
+				if out.result.Text != "Adding." || out.text != "Adding." {
+					t.Errorf("got text %q (streamed %q), want the accepted attempt only", out.result.Text, out.text)
+				}
+			},
+		},
+		{
+			name:     "retries exhausted",
+			attempts: [][]string{{invalidAddCall}, {invalidAddCall}},
+			opts:     generateOptions{Tools: addTools},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				var verr *toolValidationError
+				if !errors.As(out.err, &verr) {
+					t.Fatalf("got error %v, want *toolValidationError", out.err)
+				}
+				if len(upstream.requests) != 2 {
+					t.Errorf("got %d upstream requests, want 2", len(upstream.requests))
+				}
+				if len(out.toolCalls) != 0 {
+					t.Errorf("invalid tool calls were delivered: %v", out.toolCalls)
+				}
+			},
+		},
+		{
+			name:     "stop sequence split across chunks",
+			attempts: [][]string{{"Hello E", "ND world", " more"}},
+			opts:     generateOptions{Stop: []string{"END"}},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if out.result.Text != "Hello " || out.text != "Hello " {
+					t.Errorf("got text %q (streamed %q), want %q", out.result.Text, out.text, "Hello ")
+				}
+				if out.result.StopSequence != "END" {
+					t.Errorf("got stop sequence %q", out.result.StopSequence)
+				}
+				if !upstream.canceled {
+					t.Error("upstream was not canceled")
+				}
+			},
+		},
+		{
+			name:     "discarded attempt does not count against max_tokens",
+			attempts: [][]string{{"one two three four five", invalidAddCall}, {"six seven", validAddCall}},
+			opts:     generateOptions{Tools: addTools, MaxTokens: 40},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if out.result.MaxTokensReached || len(out.result.ToolCalls) != 1 {
+					t.Errorf("got reached=%v tool_calls=%d, want the retry to finish", out.result.MaxTokensReached, len(out.result.ToolCalls))
+				}
+				if want := tokenizer.Count("six seven" + validAddCall); out.result.OutputTokens != want {
+					t.Errorf("got output_tokens=%d, want %d (accepted attempt only)", out.result.OutputTokens, want)
+				}
+			},
+		},
+		{
+			name:      "hidden reasoning does not count against max_tokens",
+			reasoning: [][]string{{"one two three four five six seven eight"}},
+			attempts:  [][]string{{"nine ten"}},
+			opts:      generateOptions{MaxTokens: 5},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if out.result.MaxTokensReached || out.text != "nine ten" {
+					t.Errorf("got reached=%v text=%q, want the full text", out.result.MaxTokensReached, out.text)
+				}
+				if want := tokenizer.Count("nine ten"); out.result.OutputTokens != want {
+					t.Errorf("got output_tokens=%d, want %d", out.result.OutputTokens, want)
+				}
+			},
+		},
+		{
+			name:      "returned reasoning counts against max_tokens",
+			reasoning: [][]string{{"one two three four five six seven eight"}},
+			attempts:  [][]string{{"nine ten"}},
+			opts:      generateOptions{MaxTokens: 5, ReturnReasoning: true},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if !out.result.MaxTokensReached || out.text != "" || out.result.OutputTokens != 5 {
+					t.Errorf("got reached=%v text=%q output_tokens=%d, want the reasoning to use up the limit", out.result.MaxTokensReached, out.text, out.result.OutputTokens)
+				}
+			},
+		},
+		{
+			name:     "max_tokens cutoff",
+			attempts: [][]string{{"one two", " three four", " five six", " seven"}},
+			opts:     generateOptions{MaxTokens: 3},
+			check: func(t *testing.T, out generateOutput, upstream *fakeUpstream) {
+				if out.err != nil {
+					t.Fatalf("unexpected error: %v", out.err)
+				}
+				if !out.result.MaxTokensReached || out.result.OutputTokens != 3 {
+					t.Errorf("got reached=%v output_tokens=%d, want true and 3", out.result.MaxTokensReached, out.result.OutputTokens)
+				}
+				if n := tokenizer.Count(out.text); n > 3 {
+					t.Errorf("streamed %d tokens (%q), want at most 3", n, out.text)
+				}
+				if !upstream.canceled {
+					t.Error("upstream was not canceled")
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useToolValidation(t, "reprompt", 1)
+			upstream := &fakeUpstream{attempts: tc.attempts, reasoning: tc.reasoning}
+			useUpstream(t, upstream)
+			tc.check(t, runGenerate(tc.opts), upstream)
+		})
+	}
+}
+
+func TestGenerateShutdownCancel(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	upstream := &fakeUpstream{
+		attempts: [][]string{{"Hello", " world"}},
+		onChunk:  func(attempt, index int) { cancel(client.ErrShuttingDown) },
+	}
+	useUpstream(t, upstream)
+
+	_, err := generate(ctx, client.CursorChatRequest{}, generateOptions{}, generateCallbacks{})
+	if !errors.Is(err, client.ErrShuttingDown) || client.IsCanceled(err) {
+		t.Fatalf("got error %v, want client.ErrShuttingDown", err)
+	}
+	if status := errorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", status)
+	}
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cursor2api/internal/auth"
+	"cursor2api/internal/config"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// apiKeyContextKey gin.Context 中保存已认证 Key 的键名
+	apiKeyContextKey = "apiKey"
+	// modelContextKey gin.Context 中保存模型统计标签的键名
+	modelContextKey = "model"
+)
+
+// Metrics 记录请求数和耗时的中间件
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		model := c.GetString(modelContextKey)
+		if model == "" {
+			model = "none"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		metrics.RequestsTotal.Inc(route, model, status)
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), route, model, status)
+	}
+}
+
+// RequireAPIKey API Key 认证中间件
+// 从 x-api-key、Authorization: Bearer 或 Gemini 的 x-goog-api-key、?key= 读取 Key；未配置任何 Key 时直接放行
+func RequireAPIKey() gin.HandlerFunc {
+	return requireAPIKey(auth.Get())
+}
+
+// requireAPIKey 使用指定的 Key 存储认证
+func requireAPIKey(store *auth.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !store.Enabled() {
+			c.Next()
+			return
+		}
+
+		key, err := store.Authenticate(extractAPIKey(c))
+		if err != nil {
+			log.Warn("[Auth] %s %s 认证失败: %v", c.Request.Method, c.Request.URL.Path, err)
+			abortWithError(c, err)
+			return
+		}
+		if len(key.Labels) > 0 {
+			log.Debug("[Auth] 请求来自 %s %v", key.Name, key.Labels)
+		} else {
+			log.Debug("[Auth] 请求来自 %s", key.Name)
+		}
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// extractAPIKey 从请求头或查询参数中读取客户端 API Key
+func extractAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("x-api-key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	if authz := c.GetHeader("Authorization"); authz != "" {
+		if len(authz) > 7 && strings.EqualFold(authz[:7], "Bearer ") {
+			return strings.TrimSpace(authz[7:])
+		}
+	}
+	if key := c.GetHeader("x-goog-api-key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(c.Query("key"))
+}
+
+// apiKeyFromContext 返回当前请求已认证的 Key，未启用认证时返回 nil
+func apiKeyFromContext(c *gin.Context) *auth.Key {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		if key, ok := v.(*auth.Key); ok {
+			return key
+		}
+	}
+	return nil
+}
+
+// checkModelAccess 检查当前 Key 是否允许使用指定模型
+// 注册表之外的模型实际请求的是默认上游模型，按客户端传入的名称匹配会绕过限制，
+// 因此限制了模型的 Key 不能使用这类模型
+func checkModelAccess(c *gin.Context, m *models.Model) error {
+	key := apiKeyFromContext(c)
+	if key == nil || key.AllowsAnyModel() || (!m.Fallback && key.AllowsModel(m.ID)) {
+		return nil
+	}
+	return &auth.PermissionError{Message: fmt.Sprintf("API key '%s' is not allowed to use model '%s'", key.Name, m.ID)}
+}
+
+// abortWithError 按请求路径对应的协议格式返回错误并中止后续处理
+func abortWithError(c *gin.Context, err error) {
+	if lerr, ok := err.(*ratelimit.LimitError); ok {
+		c.Header("Retry-After", strconv.Itoa(lerr.RetryAfterSeconds()))
+	}
+	if isAnthropicPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(errorStatus(err), anthropicErrorBody(err))
+		return
+	}
+	if isGeminiPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(errorStatus(err), geminiErrorBody(err))
+		return
+	}
+	if isOllamaPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(errorStatus(err), ollamaErrorBody(err))
+		return
+	}
+	c.AbortWithStatusJSON(errorStatus(err), openAIErrorBody(err))
+}
+
+// isAnthropicPath 判断是否为 Anthropic Messages API 路径
+func isAnthropicPath(path string) bool {
+	return strings.HasSuffix(path, "/messages") || strings.HasSuffix(path, "/messages/count_tokens")
+}
+
+// isGeminiPath 判断是否为 Gemini API 路径
+func isGeminiPath(path string) bool {
+	return strings.HasPrefix(path, "/v1beta/")
+}
+
+// isOllamaPath 判断是否为 Ollama API 路径
+func isOllamaPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// RateLimit 限流中间件，按 API Key 和客户端 IP 限制每分钟请求数和并发数
+// 需要放在 RequireAPIKey 之后，超出限制时返回 429 和 Retry-After
+// 客户端 IP 使用 c.ClientIP()，只有来自 trusted_proxies 的 X-Forwarded-For/X-Real-IP 才会被采用
+func RateLimit() gin.HandlerFunc {
+	cfg := config.Get().RateLimit
+	limiter := ratelimit.New()
+	ipLimit := ratelimit.Limit{
+		RequestsPerMinute: cfg.PerIP.RequestsPerMinute,
+		MaxConcurrency:    cfg.PerIP.MaxConcurrency,
+	}
+
+	return func(c *gin.Context) {
+		clientIP := c.ClientIP()
+		reqs := []ratelimit.Request{{ID: "ip:" + clientIP, Limit: ipLimit}}
+		caller := "IP " + clientIP
+		if key := apiKeyFromContext(c); key != nil {
+			keyLimit := ratelimit.Limit{
+				RequestsPerMinute: cfg.PerKey.RequestsPerMinute,
+				MaxConcurrency:    cfg.PerKey.MaxConcurrency,
+			}
+			if key.RateLimit > 0 {
+				keyLimit.RequestsPerMinute = key.RateLimit
+			}
+			if key.MaxConcurrency > 0 {
+				keyLimit.MaxConcurrency = key.MaxConcurrency
+			}
+			reqs = append(reqs, ratelimit.Request{ID: "key:" + key.ID, Limit: keyLimit})
+			caller += ", Key " + key.Name
+		}
+
+		// 两个限制都检查通过后才扣减，避免被一方拒绝的请求消耗另一方的配额
+		release, err := limiter.AcquireAll(reqs...)
+		if err != nil {
+			log.Warn("[RateLimit] %s: %v", caller, err)
+			abortWithError(c, err)
+			return
+		}
+		defer release()
+
+		c.Next()
+	}
+}
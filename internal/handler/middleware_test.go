@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"cursor2api/internal/auth"
+	"cursor2api/internal/config"
+	"cursor2api/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthRouter 使用测试 Key 的路由：/check/:model 按 resolveModel 检查模型权限
+func newAuthRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	store := auth.New(config.APIKeyList{
+		{Key: "sk-all", Name: "all"},
+		{Key: "sk-claude", Name: "claude", Models: []string{"claude-4.5-*"}},
+		{Key: "sk-gpt", Name: "gpt", Models: []string{"gpt-*"}},
+		{Key: "sk-off", Name: "off", Disabled: true},
+	})
+	r := gin.New()
+	r.Use(requireAPIKey(store))
+	r.GET("/v1/models", ListModels)
+	r.GET("/check/:model", func(c *gin.Context) {
+		if _, err := resolveModel(c, c.Param("model"), models.Capabilities{}); err != nil {
+			c.JSON(errorStatus(err), openAIErrorBody(err))
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	return r
+}
+
+func TestModelAccess(t *testing.T) {
+	r := newAuthRouter()
+	cases := []struct {
+		name   string
+		key    string
+		model  string
+		status int
+	}{
+		{name: "missing key", model: "claude-4.5-opus", status: http.StatusUnauthorized},
+		{name: "wrong key", key: "sk-nope", model: "claude-4.5-opus", status: http.StatusUnauthorized},
+		{name: "disabled key", key: "sk-off", model: "claude-4.5-opus", status: http.StatusForbidden},
+		{name: "allowed model", key: "sk-claude", model: "claude-4.5-opus", status: http.StatusOK},
+		{name: "alias checked against the resolved model", key: "sk-claude", model: "claude-opus-4-5", status: http.StatusOK},
+		{name: "denied model", key: "sk-gpt", model: "claude-4.5-opus", status: http.StatusForbidden},
+		{name: "alias does not bypass the restriction", key: "sk-gpt", model: "gpt-5.2", status: http.StatusForbidden},
+		{name: "fallback model with restricted key", key: "sk-claude", model: "claude-4.5-opus-anything", status: http.StatusForbidden},
+		{name: "fallback model with unrestricted key", key: "sk-all", model: "claude-4.5-opus-anything", status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/check/"+tc.model, nil)
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, tc.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestListModelsFiltersByKey(t *testing.T) {
+	r := newAuthRouter()
+	all := make([]string, 0)
+	for _, m := range models.Get().List() {
+		all = append(all, m.ID)
+	}
+	cases := []struct {
+		key  string
+		want []string
+	}{
+		{key: "sk-all", want: all},
+		{key: "sk-claude", want: []string{"claude-4.5-opus"}},
+		{key: "sk-gpt", want: []string{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.key, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			req.Header.Set("x-api-key", tc.key)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			var resp ModelsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+			}
+			got := make([]string, 0, len(resp.Data))
+			for _, m := range resp.Data {
+				got = append(got, m.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got models %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
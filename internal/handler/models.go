@@ -5,27 +5,20 @@ import (
 	"net/http"
 	"time"
 
+	"cursor2api/internal/models"
+
 	"github.com/gin-gonic/gin"
 )
 
-// SupportedModels 支持的模型列表
-var SupportedModels = []string{
-	"claude-4.5-opus",
-	"claude-4.5-sonnet",
-	"composer-1",
-	"gemini-3-flash",
-	"gemini-3-pro",
-	"gpt-5.1-codex-max",
-	"gpt-5.2",
-	"grok-code",
-}
-
 // Model 模型信息
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID            string               `json:"id"`
+	Object        string               `json:"object"`
+	Created       int64                `json:"created"`
+	OwnedBy       string               `json:"owned_by"`
+	ContextWindow int                  `json:"context_window,omitempty"`
+	MaxOutput     int                  `json:"max_output_tokens,omitempty"`
+	Capabilities  *models.Capabilities `json:"capabilities,omitempty"`
 }
 
 // ModelsResponse 模型列表响应
@@ -34,22 +27,63 @@ type ModelsResponse struct {
 	Data   []Model `json:"data"`
 }
 
-// ListModels 返回支持的模型列表
+// ListModels 返回模型注册表中当前 Key 可以使用的模型列表
 func ListModels(c *gin.Context) {
-	models := make([]Model, len(SupportedModels))
+	registered := accessibleModels(c)
+	list := make([]Model, len(registered))
 	now := time.Now().Unix()
 
-	for i, id := range SupportedModels {
-		models[i] = Model{
-			ID:      id,
-			Object:  "model",
-			Created: now,
-			OwnedBy: "cursor",
+	for i, m := range registered {
+		caps := m.Capabilities
+		list[i] = Model{
+			ID:            m.ID,
+			Object:        "model",
+			Created:       now,
+			OwnedBy:       m.OwnedBy,
+			ContextWindow: m.ContextWindow,
+			MaxOutput:     m.MaxOutput,
+			Capabilities:  &caps,
 		}
 	}
 
 	c.JSON(http.StatusOK, ModelsResponse{
 		Object: "list",
-		Data:   models,
+		Data:   list,
 	})
 }
+
+// resolveModel 解析请求中的模型，检查当前 Key 是否有权使用以及模型是否具备请求用到的能力
+// 返回 *models.UnknownModelError、*auth.PermissionError 或 *models.CapabilityError，
+// 由各协议转换为对应的错误格式
+func resolveModel(c *gin.Context, name string, required models.Capabilities) (*models.Model, error) {
+	m, err := models.Get().Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkModelAccess(c, m); err != nil {
+		return nil, err
+	}
+	if err := m.Check(required); err != nil {
+		return nil, err
+	}
+
+	// 统计标签只使用注册表中的模型 ID，避免任意模型名导致标签数量失控
+	label := m.ID
+	if m.Fallback {
+		label = "other"
+	}
+	c.Set(modelContextKey, label)
+	return m, nil
+}
+
+// accessibleModels 返回注册表中当前 Key 有权使用的模型，规则与 resolveModel 一致
+func accessibleModels(c *gin.Context) []*models.Model {
+	registered := models.Get().List()
+	list := make([]*models.Model, 0, len(registered))
+	for _, m := range registered {
+		if checkModelAccess(c, m) == nil {
+			list = append(list, m)
+		}
+	}
+	return list
+}
@@ -0,0 +1,411 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含 Ollama API 兼容的处理函数
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ollamaVersion /api/version 返回的版本号，部分客户端会检查最低版本
+const ollamaVersion = "0.9.0"
+
+// ================== 请求/响应结构体 ==================
+
+// OllamaChatRequest /api/chat 请求格式
+type OllamaChatRequest struct {
+	Model    string                   `json:"model"`
+	Messages []OllamaMessage          `json:"messages"`
+	Tools    []toolify.ToolDefinition `json:"tools,omitempty"`
+	// Stream 未设置时默认流式输出
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+}
+
+// OllamaGenerateRequest /api/generate 请求格式
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	Suffix  string         `json:"suffix,omitempty"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"`
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+}
+
+// OllamaOptions 生成参数，使用 stop 和 num_predict（输出 token 上限），其余参数忽略
+type OllamaOptions struct {
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// OllamaMessage 对话消息，images 为不带 data URL 头的 base64 图片
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	// ToolName role=tool 时对应的工具名
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+// OllamaToolCall 工具调用，arguments 为 JSON 对象
+type OllamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// OllamaResponse /api/chat 和 /api/generate 的响应，流式响应的每一行也使用该格式
+type OllamaResponse struct {
+	Model     string         `json:"model"`
+	CreatedAt string         `json:"created_at"`
+	Message   *OllamaMessage `json:"message,omitempty"`
+	// Response /api/generate 的文本
+	Response *string `json:"response,omitempty"`
+	Done     bool    `json:"done"`
+	// 以下字段只在 done 为 true 时输出，时长单位为纳秒
+	DoneReason      string `json:"done_reason,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+	EvalDuration    int64  `json:"eval_duration,omitempty"`
+}
+
+// OllamaModel /api/tags 中的模型信息
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails 模型详情
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// ================== 处理器函数 ==================
+
+// OllamaVersion 处理 /api/version
+func OllamaVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": ollamaVersion})
+}
+
+// OllamaTags 处理 /api/tags，返回模型注册表中当前 Key 可以使用的模型
+func OllamaTags(c *gin.Context) {
+	registered := accessibleModels(c)
+	list := make([]OllamaModel, len(registered))
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for i, m := range registered {
+		name := m.ID + ":latest"
+		list[i] = OllamaModel{
+			Name:       name,
+			Model:      name,
+			ModifiedAt: now,
+			Digest:     ollamaDigest(m.ID),
+			Details:    ollamaDetails(m),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"models": list})
+}
+
+// OllamaShow 处理 /api/show，返回模型详情和能力
+func OllamaShow(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"` // 旧版字段
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Model == "" {
+		req.Model = req.Name
+	}
+
+	// 与其他接口一样检查 API Key 的模型权限，不要求任何能力
+	m, err := resolveModel(c, ollamaModelName(req.Model), models.Capabilities{})
+	if err != nil {
+		log.Warn("[Ollama] %v", err)
+		c.JSON(errorStatus(err), ollamaErrorBody(err))
+		return
+	}
+
+	capabilities := []string{"completion"}
+	if m.Capabilities.Tools {
+		capabilities = append(capabilities, "tools")
+	}
+	if m.Capabilities.Vision {
+		capabilities = append(capabilities, "vision")
+	}
+	if m.Capabilities.Reasoning {
+		capabilities = append(capabilities, "thinking")
+	}
+	details := ollamaDetails(m)
+	c.JSON(http.StatusOK, gin.H{
+		"modelfile":  "",
+		"parameters": "",
+		"template":   "",
+		"details":    details,
+		"model_info": gin.H{
+			"general.architecture":                details.Family,
+			details.Family + ".context_length":    m.ContextWindow,
+			details.Family + ".max_output_tokens": m.MaxOutput,
+			"general.basename":                    m.ID,
+			"general.upstream":                    m.Upstream,
+		},
+		"capabilities": capabilities,
+		"modified_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// OllamaChat 处理 /api/chat 请求
+func OllamaChat(c *gin.Context) {
+	var req OllamaChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream := req.Stream == nil || *req.Stream
+	log.Info("[Ollama] chat 请求: 模型=%s, 消息数=%d, 流式=%v, 工具数=%d", req.Model, len(req.Messages), stream, len(req.Tools))
+
+	chatReq := ChatCompletionRequest{Model: req.Model, Messages: make([]OpenAIMessage, 0, len(req.Messages))}
+	for _, msg := range req.Messages {
+		chatReq.Messages = append(chatReq.Messages, convertOllamaMessage(msg))
+	}
+
+	required := models.Capabilities{Tools: len(req.Tools) > 0, Vision: hasOpenAIImages(chatReq.Messages)}
+	model, err := resolveModel(c, ollamaModelName(req.Model), required)
+	if err != nil {
+		log.Warn("[Ollama] %v", err)
+		c.JSON(errorStatus(err), ollamaErrorBody(err))
+		return
+	}
+
+	cursorReq := convertOpenAIToCursor(chatReq, openAITools{Tools: req.Tools}, model.Upstream)
+	opts := generateOptions{Tools: req.Tools, ClientIP: getClientIP(c), Model: c.GetString(modelContextKey)}
+	applyOllamaOptions(&opts, req.Options, model)
+	handleOllama(c, cursorReq, req.Model, opts, stream, false)
+}
+
+// OllamaGenerate 处理 /api/generate 请求
+// 有 suffix 时按补全接口的方式要求模型填充中间内容，否则 prompt 作为一条用户消息
+func OllamaGenerate(c *gin.Context) {
+	var req OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream := req.Stream == nil || *req.Stream
+	log.Info("[Ollama] generate 请求: 模型=%s, 流式=%v, suffix=%v", req.Model, stream, req.Suffix != "")
+
+	model, err := resolveModel(c, ollamaModelName(req.Model), models.Capabilities{Vision: len(req.Images) > 0})
+	if err != nil {
+		log.Warn("[Ollama] %v", err)
+		c.JSON(errorStatus(err), ollamaErrorBody(err))
+		return
+	}
+
+	var cursorReq client.CursorChatRequest
+	if req.Suffix != "" {
+		cursorReq = convertCompletionToCursor(req.Prompt, req.Suffix, model.Upstream)
+	} else {
+		chatReq := ChatCompletionRequest{Model: req.Model}
+		if req.System != "" {
+			chatReq.Messages = append(chatReq.Messages, OpenAIMessage{Role: "system", Content: req.System})
+		}
+		chatReq.Messages = append(chatReq.Messages, convertOllamaMessage(OllamaMessage{Role: "user", Content: req.Prompt, Images: req.Images}))
+		cursorReq = convertOpenAIToCursor(chatReq, openAITools{}, model.Upstream)
+	}
+
+	opts := generateOptions{ClientIP: getClientIP(c), Model: c.GetString(modelContextKey)}
+	applyOllamaOptions(&opts, req.Options, model)
+	handleOllama(c, cursorReq, req.Model, opts, stream, true)
+}
+
+// ================== 请求转换 ==================
+
+// applyOllamaOptions 应用 options 中的 stop 和 num_predict，num_predict 为负数时使用模型的输出上限
+func applyOllamaOptions(opts *generateOptions, options *OllamaOptions, model *models.Model) {
+	numPredict := 0
+	if options != nil {
+		opts.Stop = options.Stop
+		numPredict = options.NumPredict
+	}
+	opts.MaxTokens = maxOutputTokens(numPredict, model)
+}
+
+// ollamaModelName 去掉 Ollama 模型名默认的 :latest 标签
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// ollamaDigest 根据模型 ID 生成固定的摘要，客户端用它判断模型是否变化
+func ollamaDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// ollamaDetails 模型详情，family 使用模型所有者
+func ollamaDetails(m *models.Model) OllamaModelDetails {
+	family := m.OwnedBy
+	if family == "" {
+		family = "cursor"
+	}
+	return OllamaModelDetails{Format: "api", Family: family, Families: []string{family}}
+}
+
+// convertOllamaMessage 将 Ollama 消息转换为 OpenAI 格式，复用 convertOpenAIToCursor 的转换逻辑
+func convertOllamaMessage(msg OllamaMessage) OpenAIMessage {
+	out := OpenAIMessage{Role: msg.Role, Content: msg.Content}
+	if len(msg.Images) > 0 {
+		out.ContentParts = append(out.ContentParts, OpenAIContentPart{Type: "text", Text: msg.Content})
+		for _, image := range msg.Images {
+			out.ContentParts = append(out.ContentParts, OpenAIContentPart{
+				Type:     "image_url",
+				ImageURL: &OpenAIImageURL{URL: "data:" + detectImageType(image) + ";base64," + image},
+			})
+		}
+	}
+	for _, call := range msg.ToolCalls {
+		args, _ := json.Marshal(call.Function.Arguments)
+		out.ToolCalls = append(out.ToolCalls, OpenAIToolCall{
+			Type:     "function",
+			Function: toolify.ToolCallFunction{Name: call.Function.Name, Arguments: string(args)},
+		})
+	}
+	if msg.Role == "tool" {
+		out.ToolCallID = msg.ToolName
+	}
+	return out
+}
+
+// detectImageType 根据 base64 数据的开头判断图片类型，无法判断时按 PNG 处理
+func detectImageType(data string) string {
+	switch {
+	case strings.HasPrefix(data, "/9j/"):
+		return "image/jpeg"
+	case strings.HasPrefix(data, "R0lGOD"):
+		return "image/gif"
+	case strings.HasPrefix(data, "UklGR"):
+		return "image/webp"
+	}
+	return "image/png"
+}
+
+// ================== API 处理 ==================
+
+// ollamaToolCalls 将工具调用转换为 Ollama 格式
+func ollamaToolCalls(calls []toolify.ToolCall) []OllamaToolCall {
+	result := make([]OllamaToolCall, len(calls))
+	for i, call := range calls {
+		result[i].Function.Name = call.Function.Name
+		_ = json.Unmarshal([]byte(call.Function.Arguments), &result[i].Function.Arguments)
+	}
+	return result
+}
+
+// handleOllama 处理 /api/chat 和 /api/generate 的生成，流式时按 NDJSON 每行输出一个响应对象
+// generate 为 true 时文本放在 response 字段，否则放在 message 中
+func handleOllama(c *gin.Context, cursorReq client.CursorChatRequest, model string, opts generateOptions, stream, generateAPI bool) {
+	start := time.Now()
+	newResponse := func(text string, calls []toolify.ToolCall) OllamaResponse {
+		resp := OllamaResponse{Model: model, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+		if generateAPI {
+			resp.Response = &text
+		} else {
+			resp.Message = &OllamaMessage{Role: "assistant", Content: text, ToolCalls: ollamaToolCalls(calls)}
+		}
+		return resp
+	}
+	finish := func(resp *OllamaResponse, result *generateResult) {
+		resp.Done = true
+		resp.DoneReason = "stop"
+		if result.MaxTokensReached {
+			resp.DoneReason = "length"
+		}
+		resp.TotalDuration = time.Since(start).Nanoseconds()
+		resp.EvalDuration = resp.TotalDuration
+		resp.PromptEvalCount = countInputTokens(cursorReq)
+		resp.EvalCount = result.OutputTokens
+	}
+
+	if !stream {
+		result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+		if client.IsCanceled(err) {
+			log.Info("[Ollama] 客户端已断开连接，已取消上游请求")
+			return
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), ollamaErrorBody(err))
+			return
+		}
+		resp := newResponse(result.Text, result.ToolCalls)
+		finish(&resp, result)
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
+	flusher, _ := c.Writer.(http.Flusher)
+	writeLine := func(v interface{}) {
+		line, _ := json.Marshal(v)
+		_, _ = c.Writer.Write(append(line, '\n'))
+		flusher.Flush()
+	}
+
+	onText := func(text string) {
+		writeLine(newResponse(text, nil))
+	}
+	onToolCall := func(call toolify.ToolCall) {
+		writeLine(newResponse("", []toolify.ToolCall{call}))
+	}
+
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{OnText: onText, OnToolCall: onToolCall})
+	if client.IsCanceled(err) {
+		log.Info("[Ollama] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		writeLine(ollamaErrorBody(err))
+		return
+	}
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Ollama] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
+
+	end := newResponse("", nil)
+	finish(&end, result)
+	writeLine(end)
+}
+
+// ollamaErrorBody 构建 Ollama 格式的错误响应体
+func ollamaErrorBody(err error) gin.H {
+	return gin.H{"error": err.Error()}
+}
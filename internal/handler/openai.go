@@ -3,14 +3,21 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"cursor2api/internal/auth"
 	"cursor2api/internal/client"
+	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/ratelimit"
+	"cursor2api/internal/toolify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,17 +26,129 @@ var log = logger.Get().WithPrefix("Handler")
 
 // ChatCompletionRequest OpenAI Chat Completion 请求格式
 type ChatCompletionRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OpenAIMessage `json:"messages"`
-	Stream      bool            `json:"stream"`
-	Temperature float64         `json:"temperature,omitempty"`
-	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Model       string                   `json:"model"`
+	Messages    []OpenAIMessage          `json:"messages"`
+	Stream      bool                     `json:"stream"`
+	Temperature float64                  `json:"temperature,omitempty"`
+	MaxTokens   int                      `json:"max_tokens,omitempty"`
+	Tools       []toolify.ToolDefinition `json:"tools,omitempty"`
+	ToolChoice  interface{}              `json:"tool_choice,omitempty"` // "none" / "auto" / "required" 或指定函数的对象
+	// ParallelToolCalls 为 false 时每次回复最多调用一个工具
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// 旧版 function calling 字段
+	Functions    []toolify.Function `json:"functions,omitempty"`
+	FunctionCall interface{}        `json:"function_call,omitempty"`
+	// StreamOptions 流式选项，include_usage 为 true 时在结束前发送 usage
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// Stop 停止序列，字符串或字符串数组
+	Stop interface{} `json:"stop,omitempty"`
+	// ReasoningEffort 推理强度: none / minimal / low / medium / high，非 none 时使用模型的推理上游
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// MaxCompletionTokens 新版的输出上限字段，优先于 max_tokens
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+}
+
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // OpenAIMessage OpenAI 消息格式
 type OpenAIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string                    `json:"role"`
+	Content      string                    `json:"content"`
+	Name         string                    `json:"name,omitempty"`          // 参与者名称，role=function 时为函数名
+	ToolCalls    []OpenAIToolCall          `json:"tool_calls,omitempty"`    // assistant 发起的工具调用
+	ToolCallID   string                    `json:"tool_call_id,omitempty"`  // role=tool 时对应的调用 ID
+	FunctionCall *toolify.ToolCallFunction `json:"function_call,omitempty"` // 旧版 function calling
+	// ReasoningContent 推理内容，仅在响应中输出，请求历史中的该字段不回传给上游
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// ContentParts 请求中 content 为数组时的原始内容，Content 为其中文本部分的拼接
+	ContentParts []OpenAIContentPart `json:"-"`
+}
+
+// OpenAIContentPart 内容数组中的元素
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+}
+
+// OpenAIImageURL image_url 内容，URL 可以是 http(s) 地址或 data URL
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON content 支持字符串、内容数组和 null
+func (m *OpenAIMessage) UnmarshalJSON(data []byte) error {
+	type plain OpenAIMessage
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = OpenAIMessage(raw.plain)
+
+	content := bytes.TrimSpace(raw.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+	case content[0] == '[':
+		if err := json.Unmarshal(content, &m.ContentParts); err != nil {
+			return fmt.Errorf("invalid content array: %w", err)
+		}
+		var texts []string
+		for _, part := range m.ContentParts {
+			if part.Type == "text" {
+				texts = append(texts, part.Text)
+			}
+		}
+		m.Content = strings.Join(texts, "\n")
+	default:
+		if err := json.Unmarshal(content, &m.Content); err != nil {
+			return fmt.Errorf("content must be a string or an array: %w", err)
+		}
+	}
+	return nil
+}
+
+// hasOpenAIImages 检查消息中是否包含图片
+func hasOpenAIImages(messages []OpenAIMessage) bool {
+	for _, msg := range messages {
+		for _, part := range msg.ContentParts {
+			if part.Type == "image_url" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// imageParts 返回消息中的图片，转换为上游的 file part
+func (m *OpenAIMessage) imageParts() []client.CursorPart {
+	var parts []client.CursorPart
+	for _, part := range m.ContentParts {
+		switch part.Type {
+		case "text":
+		case "image_url":
+			if part.ImageURL != nil && part.ImageURL.URL != "" {
+				parts = append(parts, imagePart("", part.ImageURL.URL))
+			}
+		default:
+			log.Warn("[OpenAI] 不支持的内容类型 %s, 已忽略", part.Type)
+		}
+	}
+	return parts
+}
+
+// OpenAIToolCall OpenAI 工具调用格式
+type OpenAIToolCall struct {
+	Index    *int                     `json:"index,omitempty"` // 仅流式增量中使用
+	ID       string                   `json:"id,omitempty"`
+	Type     string                   `json:"type,omitempty"`
+	Function toolify.ToolCallFunction `json:"function"`
 }
 
 // ChatCompletionResponse OpenAI Chat Completion 响应格式
@@ -64,6 +183,7 @@ type ChatCompletionChunk struct {
 	Created int64         `json:"created"`
 	Model   string        `json:"model"`
 	Choices []ChunkChoice `json:"choices"`
+	Usage   *OpenAIUsage  `json:"usage,omitempty"`
 }
 
 // ChunkChoice 流式选项
@@ -73,6 +193,14 @@ type ChunkChoice struct {
 	FinishReason *string       `json:"finish_reason"`
 }
 
+// openAITools 请求中生效的工具配置
+type openAITools struct {
+	Tools  []toolify.ToolDefinition
+	Legacy bool // 使用旧版 functions 字段，响应中返回 function_call
+	// Choice tool_choice / function_call 与 parallel_tool_calls 对应的约束
+	Choice toolify.ToolChoice
+}
+
 // ChatCompletions 处理 OpenAI Chat Completions API 请求
 func ChatCompletions(c *gin.Context) {
 	var req ChatCompletionRequest
@@ -81,26 +209,196 @@ func ChatCompletions(c *gin.Context) {
 		return
 	}
 
-	log.Info("[OpenAI] 请求: 模型=%s, 消息数=%d, 流式=%v", req.Model, len(req.Messages), req.Stream)
+	tools, err := resolveOpenAITools(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "tool_choice"}})
+		return
+	}
+	log.Info("[OpenAI] 请求: 模型=%s, 消息数=%d, 流式=%v, 工具数=%d", req.Model, len(req.Messages), req.Stream, len(tools.Tools))
 
-	cursorReq := convertOpenAIToCursor(req)
+	reasoning := req.ReasoningEffort != "" && req.ReasoningEffort != "none"
+	if reasoning {
+		log.Info("  推理强度: %s", req.ReasoningEffort)
+	}
+
+	// reasoning_effort 只是偏好（Cline、Continue 等客户端默认都会发送），不作为必需能力
+	required := models.Capabilities{Tools: len(tools.Tools) > 0, Vision: hasOpenAIImages(req.Messages)}
+	model, err := resolveModel(c, req.Model, required)
+	if err != nil {
+		log.Warn("[OpenAI] %v", err)
+		c.JSON(errorStatus(err), openAIErrorBody(err))
+		return
+	}
+	if reasoning && !model.Capabilities.Reasoning {
+		log.Info("  模型 %s 不支持推理, 忽略 reasoning_effort", model.ID)
+		reasoning = false
+	}
+
+	cursorReq := convertOpenAIToCursor(req, tools, model.UpstreamFor(reasoning))
+	maxTokens := req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		maxTokens = req.MaxCompletionTokens
+	}
+	opts := generateOptions{
+		Tools:      tools.Tools,
+		ClientIP:   getClientIP(c),
+		Model:      c.GetString(modelContextKey),
+		Stop:       parseStopSequences(req.Stop),
+		MaxTokens:  maxOutputTokens(maxTokens, model),
+		ToolChoice: tools.Choice,
+		// strip 模式下推理内容不返回给客户端
+		ReturnReasoning: config.Get().ReasoningContent != "strip",
+	}
 
 	if req.Stream {
-		handleOpenAIStream(c, cursorReq, req.Model)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		handleOpenAIStream(c, cursorReq, req.Model, tools.Legacy, opts, includeUsage)
 	} else {
-		handleOpenAINonStream(c, cursorReq, req.Model)
+		handleOpenAINonStream(c, cursorReq, req.Model, tools.Legacy, opts)
 	}
 }
 
+// resolveOpenAITools 合并 tools 和旧版 functions，并解析 tool_choice（旧版为 function_call）
+// none 不注入工具；required 要求至少调用一个工具；指定函数时要求调用该函数
+func resolveOpenAITools(req ChatCompletionRequest) (openAITools, error) {
+	result := openAITools{Tools: req.Tools, Choice: toolify.ToolChoice{Type: "auto"}}
+	if len(req.Tools) == 0 && len(req.Functions) > 0 {
+		result.Legacy = true
+		for _, fn := range req.Functions {
+			result.Tools = append(result.Tools, toolify.ToolDefinition{Type: "function", Function: fn})
+		}
+	}
+
+	choice := req.ToolChoice
+	if result.Legacy {
+		choice = req.FunctionCall
+	}
+	switch v := choice.(type) {
+	case nil:
+	case string:
+		switch {
+		case v == "auto":
+		case v == "none":
+			log.Debug("[OpenAI] tool_choice=none, 不注入工具")
+			result.Tools = nil
+			result.Choice.Type = "none"
+		case v == "required" && !result.Legacy:
+			result.Choice.Type = "any"
+		default:
+			return result, fmt.Errorf("unsupported tool_choice value '%s'", v)
+		}
+	case map[string]interface{}:
+		// 新版 {"type":"function","function":{"name":...}}，旧版 function_call 为 {"name":...}
+		fn := v
+		if !result.Legacy {
+			if v["type"] != "function" {
+				return result, fmt.Errorf("tool_choice.type must be 'function'")
+			}
+			fn, _ = v["function"].(map[string]interface{})
+		}
+		name, _ := fn["name"].(string)
+		if name == "" {
+			return result, fmt.Errorf("tool_choice must specify a function name")
+		}
+		result.Choice = toolify.ToolChoice{Type: "tool", Name: name}
+	default:
+		return result, fmt.Errorf("tool_choice must be a string or an object")
+	}
+
+	checked, err := validateOpenAIChoice(result.Choice, result.Tools)
+	if err != nil {
+		return result, err
+	}
+	result.Choice = checked
+	if req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+		result.Choice.DisableParallel = true
+	}
+	return result, nil
+}
+
+// validateOpenAIChoice 检查 required / 指定函数的 tool_choice 与请求中的工具是否匹配，
+// 指定函数时返回统一为声明名称的 tool_choice（匹配规则与 toolify.FindTool 一致）
+func validateOpenAIChoice(choice toolify.ToolChoice, tools []toolify.ToolDefinition) (toolify.ToolChoice, error) {
+	switch choice.Type {
+	case "any":
+		if len(tools) == 0 {
+			return choice, fmt.Errorf("tool_choice 'required' requires at least one tool")
+		}
+	case "tool":
+		tool, ok := toolify.FindTool(choice.Name, tools)
+		if !ok {
+			return choice, fmt.Errorf("function '%s' in tool_choice does not match any of the provided tools", choice.Name)
+		}
+		choice.Name = tool.GetName()
+	}
+	return choice, nil
+}
+
 // convertOpenAIToCursor 将 OpenAI 请求转换为 Cursor 格式
-func convertOpenAIToCursor(req ChatCompletionRequest) client.CursorChatRequest {
-	messages := make([]client.CursorMessage, len(req.Messages))
-	for i, msg := range req.Messages {
-		messages[i] = client.CursorMessage{
-			Parts: []client.CursorPart{{Type: "text", Text: msg.Content}},
-			ID:    generateID(),
-			Role:  msg.Role,
+func convertOpenAIToCursor(req ChatCompletionRequest, tools openAITools, upstreamModel string) client.CursorChatRequest {
+	// 检测是否有工具结果（表示工具已执行过）
+	hasToolResult := false
+	for _, msg := range req.Messages {
+		if msg.Role == "tool" || msg.Role == "function" {
+			hasToolResult = true
+			break
+		}
+	}
+
+	messages := make([]client.CursorMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		role, text := msg.Role, msg.Content
+		images := msg.imageParts()
+		switch msg.Role {
+		case "tool", "function":
+			// 工具结果以用户消息的形式回传给模型，格式与 Anthropic tool_result 一致
+			// 旧版 function 消息没有调用 ID，使用函数名
+			role = "user"
+			callID := msg.ToolCallID
+			if callID == "" {
+				callID = msg.Name
+			}
+			text = fmt.Sprintf("[Tool %s result]: %s", callID, msg.Content)
+		case "assistant":
+			// 还原历史中的工具调用，让模型看到自己之前的调用
+			calls := make([]string, 0, len(msg.ToolCalls)+1)
+			if text != "" {
+				calls = append(calls, text)
+			}
+			for _, call := range msg.ToolCalls {
+				if formatted := toolify.FormatToolCall(call.Function.Name, call.Function.Arguments); formatted != "" {
+					calls = append(calls, formatted)
+				}
+			}
+			if msg.FunctionCall != nil {
+				if formatted := toolify.FormatToolCall(msg.FunctionCall.Name, msg.FunctionCall.Arguments); formatted != "" {
+					calls = append(calls, formatted)
+				}
+			}
+			text = strings.Join(calls, "\n")
+			if text == "" && len(images) == 0 {
+				continue
+			}
+		case "user":
+			if msg.Name != "" && text != "" {
+				text = fmt.Sprintf("[%s]: %s", msg.Name, text)
+			}
+		}
+		parts := make([]client.CursorPart, 0, len(images)+1)
+		if text != "" || len(images) == 0 {
+			parts = append(parts, client.CursorPart{Type: "text", Text: text})
 		}
+		parts = append(parts, images...)
+		messages = append(messages, client.CursorMessage{
+			Parts: parts,
+			ID:    generateID(),
+			Role:  role,
+		})
+	}
+
+	messages, toolPrompt := toolify.InjectPrompt(messages, tools.Tools, tools.Choice, hasToolResult)
+	if toolPrompt != "" {
+		log.Info("[OpenAI] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(tools.Tools))
 	}
 
 	return client.CursorChatRequest{
@@ -109,73 +407,141 @@ func convertOpenAIToCursor(req ChatCompletionRequest) client.CursorChatRequest {
 			Content:  "",
 			FilePath: "/docs/",
 		}},
-		Model:    mapModelName(req.Model),
+		Model:    upstreamModel,
 		ID:       generateID(),
 		Messages: messages,
 		Trigger:  "submit-message",
 	}
 }
 
+// toOpenAIToolCalls 将解析出的工具调用转换为 OpenAI 格式
+func toOpenAIToolCalls(calls []toolify.ToolCall) []OpenAIToolCall {
+	result := make([]OpenAIToolCall, len(calls))
+	for i, call := range calls {
+		result[i] = OpenAIToolCall{
+			ID:       "call_" + generateID(),
+			Type:     "function",
+			Function: call.Function,
+		}
+	}
+	return result
+}
+
 // handleOpenAIStream 处理 OpenAI 流式请求
-func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
+// legacy 为 true 时工具调用以旧版 function_call 返回
+func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, legacy bool, opts generateOptions, includeUsage bool) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
 	id := "chatcmpl-" + generateID()
 	created := time.Now().Unix()
 	flusher, _ := c.Writer.(http.Flusher)
 
-	var buffer strings.Builder
-
-	svc := client.GetService()
-	_ = svc.SendStreamRequest(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
-
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
+	sendDelta := func(delta OpenAIMessage) {
+		chunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{{
+				Index: 0,
+				Delta: delta,
+			}},
 		}
+		chunkJSON, _ := json.Marshal(chunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
+		flusher.Flush()
+	}
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" || data == "[DONE]" {
-				continue
+	// inline 模式下推理内容包在 <think> 标签中，正文或工具调用开始前闭合
+	reasoningMode := config.Get().ReasoningContent
+	thinkOpen := false
+	closeThink := func() {
+		if thinkOpen {
+			sendDelta(OpenAIMessage{Content: thinkCloseTag})
+			thinkOpen = false
+		}
+	}
+	var onReasoning func(text string)
+	switch reasoningMode {
+	case "strip":
+	case "inline":
+		onReasoning = func(text string) {
+			if !thinkOpen {
+				text = thinkOpenTag + text
+				thinkOpen = true
 			}
+			sendDelta(OpenAIMessage{Content: text})
+		}
+	default:
+		onReasoning = func(text string) {
+			sendDelta(OpenAIMessage{ReasoningContent: text})
+		}
+	}
 
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
-				continue
-			}
+	onText := func(text string) {
+		closeThink()
+		sendDelta(OpenAIMessage{Content: text})
+	}
 
-			if event.Type == "text-delta" && event.Delta != "" {
-				chunk := ChatCompletionChunk{
-					ID:      id,
-					Object:  "chat.completion.chunk",
-					Created: created,
-					Model:   model,
-					Choices: []ChunkChoice{{
-						Index: 0,
-						Delta: OpenAIMessage{Content: event.Delta},
-					}},
-				}
-				chunkJSON, _ := json.Marshal(chunk)
-				_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
-				flusher.Flush()
+	// 工具调用解析完成后立即发送，index 按调用顺序递增
+	toolIndex := 0
+	onToolCall := func(call toolify.ToolCall) {
+		delta := OpenAIMessage{}
+		if legacy {
+			// 旧版 function_call 只支持单个调用
+			if toolIndex > 0 {
+				return
 			}
+			closeThink()
+			fn := call.Function
+			delta.FunctionCall = &fn
+		} else {
+			closeThink()
+			idx := toolIndex
+			delta.ToolCalls = toOpenAIToolCalls([]toolify.ToolCall{call})
+			delta.ToolCalls[0].Index = &idx
 		}
-	})
+		if toolIndex == 0 {
+			delta.Role = "assistant"
+		}
+		toolChunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{{Index: 0, Delta: delta}},
+		}
+		toolJSON, _ := json.Marshal(toolChunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", toolJSON)
+		flusher.Flush()
+		toolIndex++
+	}
+
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{OnText: onText, OnToolCall: onToolCall, OnReasoning: onReasoning})
+	if client.IsCanceled(err) {
+		log.Info("[OpenAI] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		errJSON, _ := json.Marshal(openAIErrorBody(err))
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", errJSON)
+		_, _ = c.Writer.WriteString("data: [DONE]\n\n")
+		flusher.Flush()
+		return
+	}
+	closeThink()
+
+	reason := openAIFinishReason(result, legacy)
+	if len(result.ToolCalls) > 0 {
+		log.Info("[OpenAI] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
 
 	// 发送结束标记
-	reason := "stop"
 	endChunk := ChatCompletionChunk{
 		ID:      id,
 		Object:  "chat.completion.chunk",
@@ -189,42 +555,58 @@ func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, mode
 	}
 	endJSON, _ := json.Marshal(endChunk)
 	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", endJSON)
+
+	// 按 stream_options.include_usage 发送 usage，choices 为空
+	if includeUsage {
+		usageChunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{},
+			Usage:   newOpenAIUsage(countInputTokens(cursorReq), result.OutputTokens),
+		}
+		usageJSON, _ := json.Marshal(usageChunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", usageJSON)
+	}
 	_, _ = c.Writer.WriteString("data: [DONE]\n\n")
 	flusher.Flush()
 }
 
 // handleOpenAINonStream 处理 OpenAI 非流式请求
-func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
-	svc := client.GetService()
-	result, err := svc.SendRequest(cursorReq)
+func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, legacy bool, opts generateOptions) {
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+	if client.IsCanceled(err) {
+		log.Info("[OpenAI] 客户端已断开连接，已取消上游请求")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), openAIErrorBody(err))
 		return
 	}
 
-	// 解析响应
-	var fullContent strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" || data == "[DONE]" {
-			continue
-		}
-
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
+	reason := openAIFinishReason(result, legacy)
+	message := &OpenAIMessage{Role: "assistant", Content: result.Text}
+	if result.Reasoning != "" {
+		switch config.Get().ReasoningContent {
+		case "strip":
+		case "inline":
+			message.Content = thinkOpenTag + result.Reasoning + thinkCloseTag + result.Text
+		default:
+			message.ReasoningContent = result.Reasoning
 		}
+	}
 
-		if event.Type == "text-delta" {
-			fullContent.WriteString(event.Delta)
+	// 工具调用
+	if toolCalls := result.ToolCalls; len(toolCalls) > 0 {
+		if legacy {
+			message.FunctionCall = &toolCalls[0].Function
+		} else {
+			message.ToolCalls = toOpenAIToolCalls(toolCalls)
 		}
+		log.Info("[OpenAI] 检测到工具调用: %d 个", len(toolCalls))
 	}
 
-	reason := "stop"
 	c.JSON(http.StatusOK, ChatCompletionResponse{
 		ID:      "chatcmpl-" + generateID(),
 		Object:  "chat.completion",
@@ -232,13 +614,64 @@ func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, m
 		Model:   model,
 		Choices: []Choice{{
 			Index:        0,
-			Message:      &OpenAIMessage{Role: "assistant", Content: fullContent.String()},
+			Message:      message,
 			FinishReason: &reason,
 		}},
-		Usage: &OpenAIUsage{
-			PromptTokens:     100,
-			CompletionTokens: 100,
-			TotalTokens:      200,
-		},
+		Usage: newOpenAIUsage(countInputTokens(cursorReq), result.OutputTokens),
 	})
 }
+
+// openAIFinishReason 根据生成结果返回 finish_reason，命中停止序列时为 stop，达到输出上限时为 length
+func openAIFinishReason(result *generateResult, legacy bool) string {
+	switch {
+	case result.StopSequence != "":
+		return "stop"
+	case result.MaxTokensReached:
+		return "length"
+	case len(result.ToolCalls) > 0 && legacy:
+		return "function_call"
+	case len(result.ToolCalls) > 0:
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// inline 模式下包裹推理内容的标签
+const (
+	thinkOpenTag  = "<think>\n"
+	thinkCloseTag = "\n</think>\n\n"
+)
+
+// newOpenAIUsage 构建 OpenAI 格式的 token 使用统计
+func newOpenAIUsage(promptTokens, completionTokens int) *OpenAIUsage {
+	return &OpenAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// openAIErrorBody 构建 OpenAI 格式的错误响应体
+func openAIErrorBody(err error) gin.H {
+	switch e := err.(type) {
+	case *toolValidationError:
+		return gin.H{"error": gin.H{
+			"message": e.Error(),
+			"type":    "tool_validation_error",
+			"details": e.Errors,
+		}}
+	case *toolify.ChoiceError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "tool_choice_error"}}
+	case *models.UnknownModelError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "invalid_request_error", "code": "model_not_found"}}
+	case *models.CapabilityError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "invalid_request_error"}}
+	case *auth.AuthenticationError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "invalid_request_error", "code": "invalid_api_key"}}
+	case *auth.PermissionError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "invalid_request_error", "code": "permission_denied"}}
+	case *ratelimit.LimitError:
+		return gin.H{"error": gin.H{"message": e.Error(), "type": "requests", "code": "rate_limit_exceeded"}}
+	}
+	return gin.H{"error": gin.H{"message": err.Error(), "type": "api_error"}}
+}
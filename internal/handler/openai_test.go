@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addToolRequest 带 add 工具的流式 Chat Completions 请求
+const addToolRequest = `{"model":"claude-4.5-opus","stream":true,
+	"messages":[{"role":"user","content":"add 2"}],
+	"tools":[{"type":"function","function":{"name":"add","parameters":{"type":"object","properties":{"n":{"type":"integer"}},"required":["n"]}}}]}`
+
+func TestChatCompletionsStreamWithTools(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		name     string
+		retries  int
+		attempts [][]string
+		// wantEarly 第一个增量是否在上游结束前发给客户端
+		wantEarly bool
+		wantText  string
+		// wantHidden 不应发给客户端的文本（被拒绝的那次尝试）
+		wantHidden string
+	}{
+		{
+			name:      "no retry left streams live",
+			retries:   0,
+			attempts:  [][]string{{"Hello", " there", validAddCall}},
+			wantEarly: true,
+			wantText:  `"content":" there"`,
+		},
+		{
+			name:       "rejected attempt is held back",
+			retries:    1,
+			attempts:   [][]string{{"Hello", " there", invalidAddCall}, {"Adding.", validAddCall}},
+			wantText:   `"content":"Adding."`,
+			wantHidden: "Hello",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useToolValidation(t, "reprompt", tc.retries)
+			w := httptest.NewRecorder()
+			// 第一个增量发出后检查客户端是否已经收到，此时上游还没有结束
+			var streamedEarly bool
+			upstream := &fakeUpstream{
+				attempts: tc.attempts,
+				onChunk: func(attempt, index int) {
+					if attempt == 0 && index == 0 {
+						streamedEarly = strings.Contains(w.Body.String(), `"content":"Hello"`)
+					}
+				},
+			}
+			useUpstream(t, upstream)
+
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(addToolRequest))
+			c.Request.Header.Set("Content-Type", "application/json")
+			ChatCompletions(c)
+
+			out := w.Body.String()
+			if streamedEarly != tc.wantEarly {
+				t.Errorf("streamed before the upstream finished = %v, want %v", streamedEarly, tc.wantEarly)
+			}
+			if len(upstream.requests) != len(tc.attempts) {
+				t.Errorf("got %d upstream requests, want %d", len(upstream.requests), len(tc.attempts))
+			}
+			if !strings.Contains(out, tc.wantText) || (tc.wantHidden != "" && strings.Contains(out, tc.wantHidden)) {
+				t.Errorf("stream does not contain only the accepted text:\n%s", out)
+			}
+			if strings.Count(out, `"name":"add"`) != 1 || !strings.Contains(out, "data: [DONE]") {
+				t.Errorf("stream does not end with exactly one tool call:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,676 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含 OpenAI Responses API 兼容的处理函数
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/conversation"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/models"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ================== 请求/响应结构体 ==================
+
+// ResponsesRequest OpenAI Responses API 请求格式
+type ResponsesRequest struct {
+	Model string `json:"model"`
+	// Input 字符串或输入项数组
+	Input        json.RawMessage `json:"input"`
+	Instructions string          `json:"instructions,omitempty"`
+	Tools        []ResponseTool  `json:"tools,omitempty"`
+	ToolChoice   interface{}     `json:"tool_choice,omitempty"`
+	Stream       bool            `json:"stream"`
+	// PreviousResponseID 续接之前的响应，对话历史从本地会话存储读取
+	PreviousResponseID string `json:"previous_response_id,omitempty"`
+	// Store 是否保存响应以便续接，默认保存
+	Store           *bool             `json:"store,omitempty"`
+	MaxOutputTokens int               `json:"max_output_tokens,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	// ParallelToolCalls 为 false 时每次回复最多调用一个工具
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+}
+
+// ResponseTool Responses API 的工具定义，函数字段与 type 平级
+type ResponseTool struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// ResponseInputItem 输入项，type 为空时视为 message
+type ResponseInputItem struct {
+	Type string `json:"type,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Content message 的内容，字符串或内容数组
+	Content json.RawMessage `json:"content,omitempty"`
+	// function_call / function_call_output 字段
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+}
+
+// ResponseInputContent 输入内容数组中的元素
+type ResponseInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// ResponseObject 响应对象
+type ResponseObject struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Model              string               `json:"model"`
+	Output             []ResponseOutputItem `json:"output"`
+	PreviousResponseID string               `json:"previous_response_id,omitempty"`
+	Instructions       string               `json:"instructions,omitempty"`
+	Metadata           map[string]string    `json:"metadata,omitempty"`
+	Usage              *ResponseUsage       `json:"usage,omitempty"`
+	Error              *ResponseError       `json:"error,omitempty"`
+	// IncompleteDetails status 为 incomplete 时的原因
+	IncompleteDetails *ResponseIncompleteDetails `json:"incomplete_details,omitempty"`
+}
+
+// ResponseIncompleteDetails 响应未完成的原因
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponseOutputItem 输出项：message 或 function_call
+type ResponseOutputItem struct {
+	Type      string                  `json:"type"`
+	ID        string                  `json:"id"`
+	Status    string                  `json:"status"`
+	Role      string                  `json:"role,omitempty"`
+	Content   []ResponseOutputContent `json:"content,omitempty"`
+	CallID    string                  `json:"call_id,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	Arguments *string                 `json:"arguments,omitempty"`
+}
+
+// ResponseOutputContent 输出消息的内容
+type ResponseOutputContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// ResponseUsage token 使用统计
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseError 失败响应的错误信息
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ================== 处理器函数 ==================
+
+// Responses 处理 OpenAI Responses API 请求
+func Responses(c *gin.Context) {
+	var req ResponsesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+
+	items, err := parseResponseInput(req.Input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "input"}})
+		return
+	}
+	history, hasToolResult, err := convertResponseInput(items)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "input"}})
+		return
+	}
+
+	// 续接之前的响应：历史消息放在本次输入之前
+	keyID := ""
+	if key := apiKeyFromContext(c); key != nil {
+		keyID = key.ID
+	}
+	if req.PreviousResponseID != "" {
+		prev, ok := conversation.Get().Load(req.PreviousResponseID)
+		if !ok || prev.KeyID != keyID {
+			c.JSON(http.StatusNotFound, gin.H{"error": gin.H{
+				"message": fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID),
+				"type":    "invalid_request_error",
+				"param":   "previous_response_id",
+				"code":    "previous_response_not_found",
+			}})
+			return
+		}
+		history = append(append([]client.CursorMessage{}, prev.Messages...), history...)
+		hasToolResult = hasToolResult || prev.HasToolResult
+	}
+
+	tools, err := responseTools(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "tool_choice"}})
+		return
+	}
+	log.Info("[Responses] 请求: 模型=%s, 输入项=%d, 流式=%v, 工具数=%d, 续接=%s", req.Model, len(items), req.Stream, len(tools.Tools), req.PreviousResponseID)
+
+	required := models.Capabilities{Tools: len(tools.Tools) > 0, Vision: hasFileParts(history)}
+	model, err := resolveModel(c, req.Model, required)
+	if err != nil {
+		log.Warn("[Responses] %v", err)
+		c.JSON(errorStatus(err), openAIErrorBody(err))
+		return
+	}
+
+	cursorReq := buildResponsesCursorRequest(req.Instructions, history, tools, hasToolResult, model.Upstream)
+	resp := &ResponseObject{
+		ID:                 "resp_" + generateID(),
+		Object:             "response",
+		CreatedAt:          time.Now().Unix(),
+		Status:             "in_progress",
+		Model:              req.Model,
+		Output:             []ResponseOutputItem{},
+		PreviousResponseID: req.PreviousResponseID,
+		Instructions:       req.Instructions,
+		Metadata:           req.Metadata,
+	}
+
+	// 完成后保存响应和包含本次回复的对话，供 previous_response_id 续接
+	save := func(result *generateResult) {
+		if req.Store != nil && !*req.Store {
+			return
+		}
+		messages := history
+		if reply := assistantHistoryText(result.Text, result.ToolCalls); reply != "" {
+			messages = append(append([]client.CursorMessage{}, history...), client.CursorMessage{
+				Parts: []client.CursorPart{{Type: "text", Text: reply}},
+				ID:    generateID(),
+				Role:  "assistant",
+			})
+		}
+		conversation.Get().Put(&conversation.Entry{
+			ID:            resp.ID,
+			Messages:      messages,
+			HasToolResult: hasToolResult,
+			Response:      resp,
+			KeyID:         keyID,
+		})
+	}
+
+	opts := generateOptions{
+		Tools:      tools.Tools,
+		ClientIP:   getClientIP(c),
+		Model:      c.GetString(modelContextKey),
+		MaxTokens:  maxOutputTokens(req.MaxOutputTokens, model),
+		ToolChoice: tools.Choice,
+	}
+	if req.Stream {
+		handleResponsesStream(c, cursorReq, resp, opts, save)
+	} else {
+		handleResponsesNonStream(c, cursorReq, resp, opts, save)
+	}
+}
+
+// GetResponse 查询已保存的响应
+func GetResponse(c *gin.Context) {
+	entry, ok := loadOwnResponse(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, entry.Response)
+}
+
+// DeleteResponse 删除已保存的响应
+func DeleteResponse(c *gin.Context) {
+	entry, ok := loadOwnResponse(c)
+	if !ok {
+		return
+	}
+	conversation.Get().Delete(entry.ID)
+	c.JSON(http.StatusOK, gin.H{"id": entry.ID, "object": "response.deleted", "deleted": true})
+}
+
+// loadOwnResponse 读取路径中的响应，不存在或属于其他 API Key 时返回 404
+func loadOwnResponse(c *gin.Context) (*conversation.Entry, bool) {
+	id := c.Param("id")
+	keyID := ""
+	if key := apiKeyFromContext(c); key != nil {
+		keyID = key.ID
+	}
+	entry, ok := conversation.Get().Load(id)
+	if !ok || entry.KeyID != keyID {
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{
+			"message": fmt.Sprintf("Response with id '%s' not found.", id),
+			"type":    "invalid_request_error",
+		}})
+		return nil, false
+	}
+	return entry, true
+}
+
+// ================== 请求转换 ==================
+
+// parseResponseInput 解析 input，字符串视为一条用户消息
+func parseResponseInput(raw json.RawMessage) ([]ResponseInputItem, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		content, _ := json.Marshal(text)
+		return []ResponseInputItem{{Type: "message", Role: "user", Content: content}}, nil
+	}
+	var items []ResponseInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of items: %w", err)
+	}
+	return items, nil
+}
+
+// convertResponseInput 将输入项转换为 Cursor 消息，工具结果以用户消息回传，格式与其他协议一致
+func convertResponseInput(items []ResponseInputItem) ([]client.CursorMessage, bool, error) {
+	messages := make([]client.CursorMessage, 0, len(items))
+	hasToolResult := false
+	for _, item := range items {
+		var role, text string
+		var images []client.CursorPart
+		switch item.Type {
+		case "", "message":
+			var err error
+			text, images, err = parseResponseContent(item.Content)
+			if err != nil {
+				return nil, false, err
+			}
+			role = item.Role
+			if role == "developer" {
+				role = "system"
+			}
+		case "function_call":
+			role = "assistant"
+			text = toolify.FormatToolCall(item.Name, item.Arguments)
+		case "function_call_output":
+			output, _, err := parseResponseContent(item.Output)
+			if err != nil {
+				return nil, false, err
+			}
+			role = "user"
+			text = fmt.Sprintf("[Tool %s result]: %s", item.CallID, output)
+			hasToolResult = true
+		default:
+			log.Warn("[Responses] 不支持的输入项类型 %s, 已忽略", item.Type)
+			continue
+		}
+		if text == "" && len(images) == 0 {
+			continue
+		}
+
+		parts := make([]client.CursorPart, 0, len(images)+1)
+		if text != "" {
+			parts = append(parts, client.CursorPart{Type: "text", Text: text})
+		}
+		parts = append(parts, images...)
+		messages = append(messages, client.CursorMessage{
+			Parts: parts,
+			ID:    generateID(),
+			Role:  role,
+		})
+	}
+	return messages, hasToolResult, nil
+}
+
+// parseResponseContent 解析字符串或内容数组，返回拼接后的文本和图片
+func parseResponseContent(raw json.RawMessage) (string, []client.CursorPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return "", nil, nil
+	}
+	if raw[0] == '"' {
+		var text string
+		err := json.Unmarshal(raw, &text)
+		return text, nil, err
+	}
+
+	var contents []ResponseInputContent
+	if err := json.Unmarshal(raw, &contents); err != nil {
+		return "", nil, fmt.Errorf("content must be a string or an array: %w", err)
+	}
+	var texts []string
+	var images []client.CursorPart
+	for _, content := range contents {
+		switch content.Type {
+		case "input_text", "output_text":
+			texts = append(texts, content.Text)
+		case "input_image":
+			if content.ImageURL != "" {
+				images = append(images, imagePart("", content.ImageURL))
+			}
+		default:
+			log.Warn("[Responses] 不支持的内容类型 %s, 已忽略", content.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// responseTools 转换函数工具并解析 tool_choice
+// none 不注入工具；required 要求至少调用一个工具；{"type":"function","name":...} 要求调用该函数
+func responseTools(req ResponsesRequest) (openAITools, error) {
+	result := openAITools{Choice: toolify.ToolChoice{Type: "auto"}}
+	switch v := req.ToolChoice.(type) {
+	case nil:
+	case string:
+		switch v {
+		case "auto":
+		case "none":
+			log.Debug("[Responses] tool_choice=none, 不注入工具")
+			result.Choice.Type = "none"
+			return result, nil
+		case "required":
+			result.Choice.Type = "any"
+		default:
+			return result, fmt.Errorf("unsupported tool_choice value '%s'", v)
+		}
+	case map[string]interface{}:
+		if v["type"] != "function" {
+			return result, fmt.Errorf("unsupported tool_choice type '%v', only 'function' is supported", v["type"])
+		}
+		name, _ := v["name"].(string)
+		if name == "" {
+			return result, fmt.Errorf("tool_choice must specify a function name")
+		}
+		result.Choice = toolify.ToolChoice{Type: "tool", Name: name}
+	default:
+		return result, fmt.Errorf("tool_choice must be a string or an object")
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			log.Warn("[Responses] 不支持的工具类型 %s, 已忽略", tool.Type)
+			continue
+		}
+		result.Tools = append(result.Tools, toolify.ToolDefinition{
+			Type: "function",
+			Function: toolify.Function{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	checked, err := validateOpenAIChoice(result.Choice, result.Tools)
+	if err != nil {
+		return result, err
+	}
+	result.Choice = checked
+	if req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+		result.Choice.DisableParallel = true
+	}
+	return result, nil
+}
+
+// hasFileParts 检查消息中是否包含图片
+func hasFileParts(messages []client.CursorMessage) bool {
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			if part.Type == "file" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildResponsesCursorRequest 组装上游请求：instructions 作为系统消息，工具提示词注入到第一条用户消息
+// history 会被保存到会话存储，这里只修改副本
+func buildResponsesCursorRequest(instructions string, history []client.CursorMessage, tools openAITools, hasToolResult bool, upstreamModel string) client.CursorChatRequest {
+	messages := make([]client.CursorMessage, 0, len(history)+1)
+	if instructions != "" {
+		messages = append(messages, client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: instructions}},
+			ID:    generateID(),
+			Role:  "system",
+		})
+	}
+
+	messages = append(messages, history...)
+
+	// InjectPrompt 不修改原有的消息，history 保持不变
+	messages, toolPrompt := toolify.InjectPrompt(messages, tools.Tools, tools.Choice, hasToolResult)
+	if toolPrompt != "" {
+		log.Info("[Responses] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(tools.Tools))
+	}
+
+	return client.CursorChatRequest{
+		Model:    upstreamModel,
+		ID:       generateID(),
+		Messages: messages,
+		Trigger:  "submit-message",
+	}
+}
+
+// assistantHistoryText 将回复还原为历史消息中的文本，工具调用使用与提示词相同的格式
+func assistantHistoryText(text string, calls []toolify.ToolCall) string {
+	lines := make([]string, 0, len(calls)+1)
+	if text != "" {
+		lines = append(lines, text)
+	}
+	for _, call := range calls {
+		if formatted := toolify.FormatToolCall(call.Function.Name, call.Function.Arguments); formatted != "" {
+			lines = append(lines, formatted)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ================== API 处理 ==================
+
+// responseError 将生成错误转换为响应对象中的 error
+func responseError(err error) *ResponseError {
+	code := "server_error"
+	if body, ok := openAIErrorBody(err)["error"].(gin.H); ok {
+		if c, ok := body["code"].(string); ok {
+			code = c
+		} else if t, ok := body["type"].(string); ok && t != "api_error" {
+			code = t
+		}
+	}
+	return &ResponseError{Code: code, Message: err.Error()}
+}
+
+// newFunctionCallItem 创建 function_call 输出项
+func newFunctionCallItem(call toolify.ToolCall, status string, arguments string) ResponseOutputItem {
+	return ResponseOutputItem{
+		Type:      "function_call",
+		ID:        "fc_" + call.ID,
+		Status:    status,
+		CallID:    "call_" + call.ID,
+		Name:      call.Function.Name,
+		Arguments: &arguments,
+	}
+}
+
+// handleResponsesStream 处理流式请求，按 Responses API 的语义事件输出
+func handleResponsesStream(c *gin.Context, cursorReq client.CursorChatRequest, resp *ResponseObject, opts generateOptions, save func(*generateResult)) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
+	flusher, _ := c.Writer.(http.Flusher)
+	sequence := 0
+	send := func(eventType string, data gin.H) {
+		data["type"] = eventType
+		data["sequence_number"] = sequence
+		sequence++
+		dataJSON, _ := json.Marshal(data)
+		_, _ = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventType, dataJSON)
+	}
+
+	send("response.created", gin.H{"response": resp})
+	send("response.in_progress", gin.H{"response": resp})
+	flusher.Flush()
+
+	// 当前正在输出的消息项
+	var textItem *ResponseOutputItem
+	var text strings.Builder
+	// 消息项开始前的空白先暂存，避免工具调用之间出现只有换行的消息
+	pendingSpace := ""
+
+	closeTextItem := func() {
+		if textItem == nil {
+			return
+		}
+		outputIndex := len(resp.Output)
+		part := ResponseOutputContent{Type: "output_text", Text: text.String(), Annotations: []interface{}{}}
+		send("response.output_text.done", gin.H{"item_id": textItem.ID, "output_index": outputIndex, "content_index": 0, "text": part.Text})
+		send("response.content_part.done", gin.H{"item_id": textItem.ID, "output_index": outputIndex, "content_index": 0, "part": part})
+		textItem.Status = "completed"
+		textItem.Content = []ResponseOutputContent{part}
+		send("response.output_item.done", gin.H{"output_index": outputIndex, "item": textItem})
+		flusher.Flush()
+		resp.Output = append(resp.Output, *textItem)
+		textItem = nil
+		text.Reset()
+	}
+
+	onText := func(delta string) {
+		outputIndex := len(resp.Output)
+		if textItem == nil {
+			if strings.TrimSpace(delta) == "" {
+				pendingSpace += delta
+				return
+			}
+			delta = pendingSpace + delta
+			pendingSpace = ""
+			textItem = &ResponseOutputItem{
+				Type:    "message",
+				ID:      "msg_" + generateID(),
+				Status:  "in_progress",
+				Role:    "assistant",
+				Content: []ResponseOutputContent{},
+			}
+			send("response.output_item.added", gin.H{"output_index": outputIndex, "item": textItem})
+			send("response.content_part.added", gin.H{
+				"item_id":       textItem.ID,
+				"output_index":  outputIndex,
+				"content_index": 0,
+				"part":          ResponseOutputContent{Type: "output_text", Text: "", Annotations: []interface{}{}},
+			})
+		}
+		text.WriteString(delta)
+		send("response.output_text.delta", gin.H{"item_id": textItem.ID, "output_index": outputIndex, "content_index": 0, "delta": delta})
+		flusher.Flush()
+	}
+
+	// 工具调用解析完成后立即发送完整的 function_call 项
+	onToolCall := func(call toolify.ToolCall) {
+		closeTextItem()
+		pendingSpace = ""
+
+		outputIndex := len(resp.Output)
+		item := newFunctionCallItem(call, "in_progress", "")
+		send("response.output_item.added", gin.H{"output_index": outputIndex, "item": item})
+		send("response.function_call_arguments.delta", gin.H{"item_id": item.ID, "output_index": outputIndex, "delta": call.Function.Arguments})
+		send("response.function_call_arguments.done", gin.H{"item_id": item.ID, "output_index": outputIndex, "arguments": call.Function.Arguments})
+		item = newFunctionCallItem(call, "completed", call.Function.Arguments)
+		send("response.output_item.done", gin.H{"output_index": outputIndex, "item": item})
+		flusher.Flush()
+		resp.Output = append(resp.Output, item)
+	}
+
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{OnText: onText, OnToolCall: onToolCall})
+	if client.IsCanceled(err) {
+		log.Info("[Responses] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		resp.Status = "failed"
+		resp.Error = responseError(err)
+		send("response.failed", gin.H{"response": resp})
+		flusher.Flush()
+		return
+	}
+	closeTextItem()
+
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Responses] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
+	finishResponse(resp, result)
+	resp.Usage = newResponseUsage(countInputTokens(cursorReq), result.OutputTokens)
+	save(result)
+
+	// 状态为 completed 或 incomplete，对应 response.completed / response.incomplete 事件
+	send("response."+resp.Status, gin.H{"response": resp})
+	flusher.Flush()
+}
+
+// handleResponsesNonStream 处理非流式请求
+func handleResponsesNonStream(c *gin.Context, cursorReq client.CursorChatRequest, resp *ResponseObject, opts generateOptions, save func(*generateResult)) {
+	result, err := generate(c.Request.Context(), cursorReq, opts, generateCallbacks{})
+	if client.IsCanceled(err) {
+		log.Info("[Responses] 客户端已断开连接，已取消上游请求")
+		return
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), openAIErrorBody(err))
+		return
+	}
+
+	if result.Text != "" || len(result.ToolCalls) == 0 {
+		resp.Output = append(resp.Output, ResponseOutputItem{
+			Type:    "message",
+			ID:      "msg_" + generateID(),
+			Status:  "completed",
+			Role:    "assistant",
+			Content: []ResponseOutputContent{{Type: "output_text", Text: result.Text, Annotations: []interface{}{}}},
+		})
+	}
+	for _, call := range result.ToolCalls {
+		resp.Output = append(resp.Output, newFunctionCallItem(call, "completed", call.Function.Arguments))
+	}
+	if len(result.ToolCalls) > 0 {
+		log.Info("[Responses] 检测到工具调用: %d 个", len(result.ToolCalls))
+	}
+
+	finishResponse(resp, result)
+	resp.Usage = newResponseUsage(countInputTokens(cursorReq), result.OutputTokens)
+	save(result)
+	c.JSON(http.StatusOK, resp)
+}
+
+// finishResponse 根据生成结果设置响应状态，达到 max_output_tokens 时为 incomplete
+func finishResponse(resp *ResponseObject, result *generateResult) {
+	if result.MaxTokensReached {
+		resp.Status = "incomplete"
+		resp.IncompleteDetails = &ResponseIncompleteDetails{Reason: "max_output_tokens"}
+		return
+	}
+	resp.Status = "completed"
+}
+
+// newResponseUsage 创建 usage，total 为两者之和
+func newResponseUsage(input, output int) *ResponseUsage {
+	return &ResponseUsage{InputTokens: input, OutputTokens: output, TotalTokens: input + output}
+}
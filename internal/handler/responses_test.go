@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/conversation"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseEvent 返回流式响应中指定事件的 response 对象
+func responseEvent(t *testing.T, body, eventType string) ResponseObject {
+	t.Helper()
+	for _, block := range strings.Split(body, "\n\n") {
+		if !strings.HasPrefix(block, "event: "+eventType+"\n") {
+			continue
+		}
+		var event struct {
+			Response ResponseObject `json:"response"`
+		}
+		data := strings.TrimPrefix(block[strings.Index(block, "\n")+1:], "data: ")
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid %s event: %v", eventType, err)
+		}
+		return event.Response
+	}
+	t.Fatalf("no %s event in stream:\n%s", eventType, body)
+	return ResponseObject{}
+}
+
+func TestResponsesStreamRepromptKeepsAcceptedAttemptOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useToolValidation(t, "reprompt", 1)
+	upstream := &fakeUpstream{attempts: [][]string{{"Hello", invalidAddCall}, {"Adding.", validAddCall}}}
+	useUpstream(t, upstream)
+
+	body := `{"model":"claude-4.5-opus","stream":true,"input":"add 2",
+		"tools":[{"type":"function","name":"add","parameters":{"type":"object","properties":{"n":{"type":"integer"}},"required":["n"]}}]}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	Responses(c)
+
+	out := w.Body.String()
+	if strings.Contains(out, "Hello") {
+		t.Errorf("rejected attempt was streamed:\n%s", out)
+	}
+	resp := responseEvent(t, out, "response.completed")
+	if len(resp.Output) != 2 || resp.Output[0].Type != "message" || resp.Output[1].Type != "function_call" {
+		t.Fatalf("got output %+v, want one message and one function_call", resp.Output)
+	}
+	if got := resp.Output[0].Content[0].Text; got != "Adding." {
+		t.Errorf("got message text %q, want %q", got, "Adding.")
+	}
+
+	// 续接时重放的历史与客户端收到的内容一致
+	entry, ok := conversation.Get().Load(resp.ID)
+	if !ok {
+		t.Fatalf("response %s was not stored", resp.ID)
+	}
+	reply := entry.Messages[len(entry.Messages)-1]
+	call := resp.Output[1]
+	want := assistantHistoryText(resp.Output[0].Content[0].Text, []toolify.ToolCall{{
+		Function: toolify.ToolCallFunction{Name: call.Name, Arguments: *call.Arguments},
+	}})
+	if reply.Role != "assistant" || reply.Parts[0].Text != want {
+		t.Errorf("stored reply %q, want %q (the streamed output)", reply.Parts[0].Text, want)
+	}
+}
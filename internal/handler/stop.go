@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"strings"
+)
+
+// stopMatcher 在流式文本中查找停止序列
+// 停止序列可能跨多个分片，可能是停止序列开头的尾部文本会先暂存，确认不匹配后再输出
+type stopMatcher struct {
+	stops []string
+	held  string
+}
+
+// newStopMatcher 创建停止序列匹配器，忽略空字符串
+func newStopMatcher(stops []string) *stopMatcher {
+	m := &stopMatcher{}
+	for _, s := range stops {
+		if s != "" {
+			m.stops = append(m.stops, s)
+		}
+	}
+	if len(m.stops) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Feed 输入文本增量，返回可以输出的文本
+// 命中停止序列时返回停止序列之前的文本和命中的序列，之后的输入应丢弃
+func (m *stopMatcher) Feed(text string) (string, string) {
+	buf := m.held + text
+	m.held = ""
+
+	// 多个序列都出现时取最靠前的
+	index, matched := -1, ""
+	for _, s := range m.stops {
+		if i := strings.Index(buf, s); i >= 0 && (index < 0 || i < index) {
+			index, matched = i, s
+		}
+	}
+	if index >= 0 {
+		return buf[:index], matched
+	}
+
+	keep := 0
+	for _, s := range m.stops {
+		for n := len(s) - 1; n > keep; n-- {
+			if strings.HasSuffix(buf, s[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	m.held = buf[len(buf)-keep:]
+	return buf[:len(buf)-keep], ""
+}
+
+// Flush 返回暂存的文本，在输出结束或插入工具调用前调用
+func (m *stopMatcher) Flush() string {
+	held := m.held
+	m.held = ""
+	return held
+}
+
+// parseStopSequences 解析 OpenAI 的 stop 参数，支持字符串和字符串数组
+func parseStopSequences(v interface{}) []string {
+	switch s := v.(type) {
+	case string:
+		return []string{s}
+	case []interface{}:
+		stops := make([]string, 0, len(s))
+		for _, item := range s {
+			if str, ok := item.(string); ok {
+				stops = append(stops, str)
+			}
+		}
+		return stops
+	}
+	return nil
+}
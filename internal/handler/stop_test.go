@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+// feedStop 按分片依次输入，返回输出的全部文本和命中的停止序列
+// 命中后不再输入，未命中时追加 Flush 的内容
+func feedStop(m *stopMatcher, chunks []string) (string, string) {
+	var out string
+	for _, chunk := range chunks {
+		text, matched := m.Feed(chunk)
+		out += text
+		if matched != "" {
+			return out, matched
+		}
+	}
+	return out + m.Flush(), ""
+}
+
+func TestStopMatcher(t *testing.T) {
+	cases := []struct {
+		name        string
+		stops       []string
+		input       string
+		wantText    string
+		wantMatched string
+	}{
+		{name: "no match", stops: []string{"END"}, input: "hello world", wantText: "hello world"},
+		{name: "match in middle", stops: []string{"END"}, input: "helloENDworld", wantText: "hello", wantMatched: "END"},
+		{name: "match at start", stops: []string{"END"}, input: "ENDhello", wantText: "", wantMatched: "END"},
+		{name: "earliest of several", stops: []string{"world", "lo"}, input: "hello world", wantText: "hel", wantMatched: "lo"},
+		{name: "partial prefix at end is released", stops: []string{"END"}, input: "helloEN", wantText: "helloEN"},
+		{name: "repeated prefix", stops: []string{"aab"}, input: "xaaab", wantText: "xa", wantMatched: "aab"},
+		{name: "newline stop", stops: []string{"\n\n"}, input: "line1\nline2\n\nrest", wantText: "line1\nline2", wantMatched: "\n\n"},
+		{name: "multibyte stop", stops: []string{"结束"}, input: "你好结束再见", wantText: "你好", wantMatched: "结束"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// 在每个字节位置切分，结果应与整段输入一致
+			for i := 0; i <= len(tc.input); i++ {
+				m := newStopMatcher(tc.stops)
+				text, matched := feedStop(m, []string{tc.input[:i], tc.input[i:]})
+				if text != tc.wantText || matched != tc.wantMatched {
+					t.Fatalf("split at %d: got (%q, %q), want (%q, %q)", i, text, matched, tc.wantText, tc.wantMatched)
+				}
+			}
+
+			chunks := make([]string, len(tc.input))
+			for i := 0; i < len(tc.input); i++ {
+				chunks[i] = tc.input[i : i+1]
+			}
+			text, matched := feedStop(newStopMatcher(tc.stops), chunks)
+			if text != tc.wantText || matched != tc.wantMatched {
+				t.Fatalf("byte by byte: got (%q, %q), want (%q, %q)", text, matched, tc.wantText, tc.wantMatched)
+			}
+		})
+	}
+}
+
+func TestStopMatcherHoldsOnlyPossiblePrefix(t *testing.T) {
+	m := newStopMatcher([]string{"STOP"})
+	if text, _ := m.Feed("abcST"); text != "abc" {
+		t.Fatalf("got %q, want %q", text, "abc")
+	}
+	if text, _ := m.Feed("x"); text != "STx" {
+		t.Fatalf("got %q, want %q", text, "STx")
+	}
+	if held := m.Flush(); held != "" {
+		t.Fatalf("held %q after mismatch", held)
+	}
+}
+
+func TestNewStopMatcherIgnoresEmpty(t *testing.T) {
+	if m := newStopMatcher(nil); m != nil {
+		t.Fatal("expected nil matcher without stop sequences")
+	}
+	if m := newStopMatcher([]string{""}); m != nil {
+		t.Fatal("expected nil matcher with only empty stop sequences")
+	}
+}
+
+func TestParseStopSequences(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want []string
+	}{
+		{in: nil, want: nil},
+		{in: "END", want: []string{"END"}},
+		{in: []interface{}{"a", 1, "b"}, want: []string{"a", "b"}},
+		{in: 42, want: nil},
+	}
+	for _, tc := range cases {
+		if got := parseStopSequences(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseStopSequences(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
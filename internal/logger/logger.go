@@ -154,4 +154,12 @@ func Debug(format string, args ...any) { Get().Debug(format, args...) }
 func Info(format string, args ...any)  { Get().Info(format, args...) }
 func Warn(format string, args ...any)  { Get().Warn(format, args...) }
 func Error(format string, args ...any) { Get().Error(format, args...) }
-func Sync()                            { Get().Sync() }
+
+// Sync 刷新默认日志器和所有模块日志器的缓冲，退出前调用
+func Sync() {
+	Get().Sync()
+	moduleLoggers.Range(func(_, value any) bool {
+		value.(*Logger).Sync()
+		return true
+	})
+}
@@ -0,0 +1,29 @@
+package metrics
+
+// 服务使用的全部指标
+var (
+	// RequestsTotal API 请求数
+	RequestsTotal = NewCounter("cursor2api_requests_total",
+		"API 请求数", "route", "model", "status")
+	// RequestDuration API 请求耗时（流式请求为整个响应的时长），标签与 RequestsTotal 相同
+	RequestDuration = NewHistogram("cursor2api_request_duration_seconds",
+		"API 请求耗时（秒）", DefaultBuckets, "route", "model", "status")
+	// TimeToFirstToken 从发送上游请求到收到第一个文本或工具调用的时间
+	TimeToFirstToken = NewHistogram("cursor2api_time_to_first_token_seconds",
+		"首个 token 延迟（秒）", DefaultBuckets, "model")
+	// ActiveStreams 进行中的流式响应数
+	ActiveStreams = NewGauge("cursor2api_active_streams",
+		"进行中的流式响应数")
+	// UpstreamErrors 上游错误数，status 为 HTTP 状态码、timeout、network 或 event（流中的错误事件）
+	UpstreamErrors = NewCounter("cursor2api_upstream_errors_total",
+		"上游错误数", "status")
+	// ToolCalls 模型输出的工具调用数，result 为 ok 或 invalid（参数校验失败）
+	ToolCalls = NewCounter("cursor2api_tool_calls_total",
+		"工具调用数", "model", "result")
+	// TokenGenerationDuration x-is-human token 生成耗时
+	TokenGenerationDuration = NewHistogram("cursor2api_token_generation_duration_seconds",
+		"x-is-human token 生成耗时（秒）", []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30})
+	// TokenGenerationFailures x-is-human token 生成失败次数
+	TokenGenerationFailures = NewCounter("cursor2api_token_generation_failures_total",
+		"x-is-human token 生成失败次数")
+)
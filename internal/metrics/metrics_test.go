@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// output 返回单个指标的文本
+func output(c collector) string {
+	var buf bytes.Buffer
+	c.write(&buf)
+	return buf.String()
+}
+
+func TestExposition(t *testing.T) {
+	cases := []struct {
+		name   string
+		metric func() collector
+		want   string
+	}{
+		{
+			name:   "counter without labels outputs zero",
+			metric: func() collector { return NewCounter("test_empty_total", "empty") },
+			want:   "# HELP test_empty_total empty\n# TYPE test_empty_total counter\ntest_empty_total 0\n",
+		},
+		{
+			name: "counter with labels sorted",
+			metric: func() collector {
+				c := NewCounter("test_requests_total", "requests", "route", "status")
+				c.Inc("/b", "200")
+				c.Add(2, "/a", "500")
+				c.Inc("/b", "200")
+				return c
+			},
+			want: "# HELP test_requests_total requests\n# TYPE test_requests_total counter\n" +
+				`test_requests_total{route="/a",status="500"} 2` + "\n" +
+				`test_requests_total{route="/b",status="200"} 2` + "\n",
+		},
+		{
+			name: "label escaping",
+			metric: func() collector {
+				c := NewCounter("test_escape_total", "escape", "value")
+				c.Inc("a\"b\\c\nd")
+				return c
+			},
+			want: "# HELP test_escape_total escape\n# TYPE test_escape_total counter\n" +
+				`test_escape_total{value="a\"b\\c\nd"} 1` + "\n",
+		},
+		{
+			name: "gauge",
+			metric: func() collector {
+				g := NewGauge("test_active", "active")
+				g.Inc()
+				g.Inc()
+				g.Dec()
+				g.Add(0.5)
+				return g
+			},
+			want: "# HELP test_active active\n# TYPE test_active gauge\ntest_active 1.5\n",
+		},
+		{
+			name: "histogram buckets are cumulative",
+			metric: func() collector {
+				h := NewHistogram("test_duration_seconds", "duration", []float64{0.1, 1}, "model")
+				h.Observe(0.05, "m")
+				h.Observe(0.5, "m")
+				h.Observe(3, "m")
+				return h
+			},
+			want: "# HELP test_duration_seconds duration\n# TYPE test_duration_seconds histogram\n" +
+				`test_duration_seconds_bucket{model="m",le="0.1"} 1` + "\n" +
+				`test_duration_seconds_bucket{model="m",le="1"} 2` + "\n" +
+				`test_duration_seconds_bucket{model="m",le="+Inf"} 3` + "\n" +
+				`test_duration_seconds_sum{model="m"} 3.55` + "\n" +
+				`test_duration_seconds_count{model="m"} 3` + "\n",
+		},
+		{
+			name: "wrong label count is ignored",
+			metric: func() collector {
+				c := NewCounter("test_wrong_total", "wrong", "a", "b")
+				c.Inc("only-one")
+				NewHistogram("test_wrong_seconds", "wrong", DefaultBuckets, "a").Observe(1)
+				return c
+			},
+			want: "# HELP test_wrong_total wrong\n# TYPE test_wrong_total counter\n",
+		},
+		{
+			name: "func metric",
+			metric: func() collector {
+				NewGaugeFunc("test_func", "func", func() float64 { return 42 })
+				return registry[len(registry)-1]
+			},
+			want: "# HELP test_func func\n# TYPE test_func gauge\ntest_func 42\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := output(tc.metric()); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "handler").Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type = %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "test_handler_total 1\n") || !strings.Contains(w.Body.String(), "# TYPE cursor2api_requests_total counter") {
+		t.Errorf("body does not include the registered metrics:\n%s", w.Body.String())
+	}
+}
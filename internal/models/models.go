@@ -0,0 +1,217 @@
+// Package models 提供模型注册表，负责模型 ID/别名解析、上游模型映射和能力查询
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+)
+
+var log = logger.Get().WithPrefix("Models")
+
+const (
+	// DefaultContextWindow 未配置时的上下文窗口大小
+	DefaultContextWindow = 200000
+	// DefaultMaxOutput 未配置时的最大输出 token 数
+	DefaultMaxOutput = 64000
+)
+
+// Capabilities 模型能力
+type Capabilities struct {
+	Tools     bool `json:"tools"`
+	Vision    bool `json:"vision"`
+	Reasoning bool `json:"reasoning"`
+}
+
+// allCapabilities 未声明能力的模型默认全部支持
+var allCapabilities = Capabilities{Tools: true, Vision: true, Reasoning: true}
+
+// Model 注册表中的模型
+type Model struct {
+	// ID 对外暴露的模型 ID
+	ID string
+	// Upstream 实际请求的上游模型
+	Upstream string
+	// ReasoningUpstream 请求思考时使用的上游模型，为空时使用 Upstream
+	ReasoningUpstream string
+	// Aliases 模型别名
+	Aliases []string
+	// ContextWindow 上下文窗口大小（token）
+	ContextWindow int
+	// MaxOutput 最大输出 token 数
+	MaxOutput int
+	// Capabilities 模型能力
+	Capabilities Capabilities
+	// OwnedBy 模型所有者
+	OwnedBy string
+	// Fallback 为 true 表示模型不在注册表中，映射到了默认上游模型
+	Fallback bool
+}
+
+// UnknownModelError 严格模式下请求了注册表之外的模型
+type UnknownModelError struct {
+	Name string
+}
+
+func (e *UnknownModelError) Error() string {
+	return fmt.Sprintf("model '%s' not found", e.Name)
+}
+
+// CapabilityError 请求用到了模型不支持的能力
+type CapabilityError struct {
+	Model      string
+	Capability string
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("model '%s' does not support %s", e.Model, e.Capability)
+}
+
+// Check 检查模型是否具备 required 中要求的全部能力，不满足时返回 *CapabilityError
+func (m *Model) Check(required Capabilities) error {
+	missing := ""
+	switch {
+	case required.Tools && !m.Capabilities.Tools:
+		missing = "tools"
+	case required.Vision && !m.Capabilities.Vision:
+		missing = "vision"
+	case required.Reasoning && !m.Capabilities.Reasoning:
+		missing = "reasoning"
+	}
+	if missing == "" {
+		return nil
+	}
+	return &CapabilityError{Model: m.ID, Capability: missing}
+}
+
+// UpstreamFor 返回实际请求的上游模型，reasoning 为 true 时优先使用 ReasoningUpstream
+func (m *Model) UpstreamFor(reasoning bool) string {
+	if reasoning && m.ReasoningUpstream != "" {
+		return m.ReasoningUpstream
+	}
+	return m.Upstream
+}
+
+// Registry 模型注册表
+type Registry struct {
+	models          []*Model
+	index           map[string]*Model
+	defaultUpstream string
+	strict          bool
+}
+
+var (
+	registry     *Registry
+	registryOnce sync.Once
+)
+
+// Get 获取全局模型注册表（单例模式）
+func Get() *Registry {
+	registryOnce.Do(func() {
+		cfg := config.Get()
+		registry = New(cfg.Models, cfg.DefaultUpstreamModel, cfg.StrictModels)
+		log.Info("模型注册表已加载: %d 个模型, 严格模式: %v", len(registry.models), registry.strict)
+	})
+	return registry
+}
+
+// New 根据配置创建模型注册表
+func New(list config.ModelList, defaultUpstream string, strict bool) *Registry {
+	r := &Registry{
+		index:           make(map[string]*Model),
+		defaultUpstream: defaultUpstream,
+		strict:          strict,
+	}
+	for _, mc := range list {
+		m := &Model{
+			ID:                mc.ID,
+			Upstream:          mc.Upstream,
+			ReasoningUpstream: mc.ReasoningUpstream,
+			Aliases:           mc.Aliases,
+			ContextWindow:     mc.ContextWindow,
+			MaxOutput:         mc.MaxOutput,
+			Capabilities:      allCapabilities,
+			OwnedBy:           mc.OwnedBy,
+		}
+		if len(mc.Capabilities) > 0 {
+			m.Capabilities = parseCapabilities(mc.Capabilities)
+		}
+		r.fillDefaults(m)
+
+		if _, exists := r.index[strings.ToLower(m.ID)]; exists {
+			log.Warn("模型 %s 重复定义，已忽略", m.ID)
+			continue
+		}
+		r.models = append(r.models, m)
+		r.index[strings.ToLower(m.ID)] = m
+		for _, alias := range m.Aliases {
+			key := strings.ToLower(alias)
+			if other, exists := r.index[key]; exists {
+				log.Warn("模型别名 %s 已被 %s 使用，已忽略", alias, other.ID)
+				continue
+			}
+			r.index[key] = m
+		}
+	}
+	return r
+}
+
+// fillDefaults 填充未配置的字段
+func (r *Registry) fillDefaults(m *Model) {
+	if m.Upstream == "" {
+		m.Upstream = r.defaultUpstream
+	}
+	if m.ContextWindow <= 0 {
+		m.ContextWindow = DefaultContextWindow
+	}
+	if m.MaxOutput <= 0 {
+		m.MaxOutput = DefaultMaxOutput
+	}
+	if m.OwnedBy == "" {
+		m.OwnedBy = "cursor"
+	}
+}
+
+func parseCapabilities(names []string) Capabilities {
+	var caps Capabilities
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "tools":
+			caps.Tools = true
+		case "vision":
+			caps.Vision = true
+		case "reasoning":
+			caps.Reasoning = true
+		default:
+			log.Warn("未知的模型能力: %s", name)
+		}
+	}
+	return caps
+}
+
+// List 返回注册表中的全部模型，顺序与配置一致
+func (r *Registry) List() []*Model {
+	return r.models
+}
+
+// Resolve 按模型 ID 或别名查找模型（忽略大小写）
+// 找不到时，严格模式返回 *UnknownModelError，否则返回映射到默认上游模型的临时模型
+func (r *Registry) Resolve(name string) (*Model, error) {
+	if m, ok := r.index[strings.ToLower(strings.TrimSpace(name))]; ok {
+		if m.Upstream != name {
+			log.Debug("模型映射: %s -> %s", name, m.Upstream)
+		}
+		return m, nil
+	}
+	if r.strict {
+		return nil, &UnknownModelError{Name: name}
+	}
+
+	m := &Model{ID: name, Capabilities: allCapabilities, Fallback: true}
+	r.fillDefaults(m)
+	log.Warn("未注册的模型 %s, 使用默认上游模型 %s", name, m.Upstream)
+	return m, nil
+}
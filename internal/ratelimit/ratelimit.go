@@ -0,0 +1,153 @@
+// Package ratelimit 提供按调用方的令牌桶限流和并发数限制
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// idleTimeout 超过该时间没有请求且没有进行中请求的调用方会被清理
+const idleTimeout = 10 * time.Minute
+
+// Limit 单个调用方的限制，字段为 0 表示不限制
+type Limit struct {
+	// RequestsPerMinute 每分钟最多请求数，允许短时间内突发到该数量
+	RequestsPerMinute int
+	// MaxConcurrency 最大同时进行的请求数
+	MaxConcurrency int
+}
+
+// LimitError 超出限制时返回的错误
+type LimitError struct {
+	Message string
+	// RetryAfter 建议客户端等待的时间
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// RetryAfterSeconds 返回 Retry-After 响应头使用的秒数（至少为 1）
+func (e *LimitError) RetryAfterSeconds() int {
+	secs := int(math.Ceil(e.RetryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// entry 单个调用方的状态
+type entry struct {
+	tokens   float64
+	updated  time.Time
+	lastSeen time.Time
+	inflight int
+}
+
+// Limiter 按调用方标识限流
+type Limiter struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	lastGC  time.Time
+}
+
+// New 创建限流器
+func New() *Limiter {
+	return &Limiter{
+		entries: make(map[string]*entry),
+	}
+}
+
+// Request 一个调用方标识及其限制
+type Request struct {
+	ID    string
+	Limit Limit
+}
+
+// Acquire 为调用方占用一次请求配额
+// 成功时返回 release，请求结束后必须调用以释放并发数；超出限制时返回 *LimitError
+func (l *Limiter) Acquire(id string, limit Limit) (release func(), err error) {
+	return l.AcquireAll(Request{ID: id, Limit: limit})
+}
+
+// AcquireAll 同时为多个调用方占用配额，先检查全部限制，都未超出时才扣减，
+// 任一超出时不占用任何配额并返回 *LimitError
+func (l *Limiter) AcquireAll(reqs ...Request) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.gc(now)
+
+	entries := make([]*entry, 0, len(reqs))
+	limits := make([]Limit, 0, len(reqs))
+	for _, req := range reqs {
+		limit := req.Limit
+		if limit.RequestsPerMinute <= 0 && limit.MaxConcurrency <= 0 {
+			continue
+		}
+		e, ok := l.entries[req.ID]
+		if !ok {
+			e = &entry{tokens: float64(limit.RequestsPerMinute), updated: now}
+			l.entries[req.ID] = e
+		}
+		e.lastSeen = now
+
+		if limit.MaxConcurrency > 0 && e.inflight >= limit.MaxConcurrency {
+			return nil, &LimitError{
+				Message:    fmt.Sprintf("too many concurrent requests (limit %d)", limit.MaxConcurrency),
+				RetryAfter: time.Second,
+			}
+		}
+
+		if rpm := float64(limit.RequestsPerMinute); rpm > 0 {
+			// 按经过的时间补充令牌，桶容量为每分钟请求数
+			perSecond := rpm / 60
+			e.tokens = math.Min(rpm, e.tokens+now.Sub(e.updated).Seconds()*perSecond)
+			e.updated = now
+			if e.tokens < 1 {
+				wait := time.Duration((1 - e.tokens) / perSecond * float64(time.Second))
+				return nil, &LimitError{
+					Message:    fmt.Sprintf("rate limit exceeded (%d requests per minute)", limit.RequestsPerMinute),
+					RetryAfter: wait,
+				}
+			}
+		}
+		entries = append(entries, e)
+		limits = append(limits, limit)
+	}
+
+	for i, e := range entries {
+		if limits[i].RequestsPerMinute > 0 {
+			e.tokens--
+		}
+		e.inflight++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			for _, e := range entries {
+				e.inflight--
+				e.lastSeen = time.Now()
+			}
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// gc 清理长时间空闲的调用方，调用方需持有锁
+func (l *Limiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < time.Minute {
+		return
+	}
+	l.lastGC = now
+	for id, e := range l.entries {
+		if e.inflight == 0 && now.Sub(e.lastSeen) > idleTimeout {
+			delete(l.entries, id)
+		}
+	}
+}
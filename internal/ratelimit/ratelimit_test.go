@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAcquireRequestsPerMinute(t *testing.T) {
+	l := New()
+	limit := Limit{RequestsPerMinute: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire("key", limit); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i+1, err)
+		}
+	}
+	_, err := l.Acquire("key", limit)
+	var lerr *LimitError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("expected *LimitError, got %v", err)
+	}
+	// 每分钟 2 次，补充一个令牌约需 30 秒
+	if secs := lerr.RetryAfterSeconds(); secs < 29 || secs > 30 {
+		t.Errorf("RetryAfterSeconds = %d, want about 30", secs)
+	}
+	if _, err := l.Acquire("other", limit); err != nil {
+		t.Errorf("other caller should not be limited: %v", err)
+	}
+}
+
+func TestAcquireMaxConcurrency(t *testing.T) {
+	l := New()
+	limit := Limit{MaxConcurrency: 1}
+	release, err := l.Acquire("key", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("key", limit); err == nil {
+		t.Fatal("expected concurrency limit error")
+	}
+	release()
+	// 重复调用 release 不应多次释放
+	release()
+	second, err := l.Acquire("key", limit)
+	if err != nil {
+		t.Fatalf("expected slot after release: %v", err)
+	}
+	if _, err := l.Acquire("key", limit); err == nil {
+		t.Fatal("double release freed more than one slot")
+	}
+	second()
+}
+
+func TestAcquireUnlimited(t *testing.T) {
+	l := New()
+	for i := 0; i < 100; i++ {
+		if _, err := l.Acquire("key", Limit{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestAcquireAllChecksBeforeConsuming(t *testing.T) {
+	cases := []struct {
+		name    string
+		blocked Request
+	}{
+		{name: "rate", blocked: Request{ID: "ip", Limit: Limit{RequestsPerMinute: 1}}},
+		{name: "concurrency", blocked: Request{ID: "ip", Limit: Limit{MaxConcurrency: 1}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := New()
+			if _, err := l.Acquire(tc.blocked.ID, tc.blocked.Limit); err != nil {
+				t.Fatal(err)
+			}
+
+			key := Request{ID: "key", Limit: Limit{RequestsPerMinute: 1, MaxConcurrency: 1}}
+			// key 排在前面，ip 被拒绝时 key 的配额不应被扣减
+			if _, err := l.AcquireAll(key, tc.blocked); err == nil {
+				t.Fatal("expected limit error")
+			}
+			release, err := l.AcquireAll(key)
+			if err != nil {
+				t.Fatalf("key quota was consumed by a rejected request: %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestAcquireAllReleasesEveryEntry(t *testing.T) {
+	l := New()
+	key := Request{ID: "key", Limit: Limit{MaxConcurrency: 1}}
+	ip := Request{ID: "ip", Limit: Limit{MaxConcurrency: 1}}
+	release, err := l.AcquireAll(key, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	for _, req := range []Request{key, ip} {
+		if _, err := l.Acquire(req.ID, req.Limit); err != nil {
+			t.Errorf("%s not released: %v", req.ID, err)
+		}
+	}
+}
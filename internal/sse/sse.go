@@ -0,0 +1,170 @@
+// Package sse 提供 Cursor 上游 SSE 响应流的解码
+// 将 "data: {...}" 行转换为带类型的事件，供各协议处理器共用
+package sse
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// EventType 事件类型
+type EventType string
+
+const (
+	// EventTextDelta 文本增量
+	EventTextDelta EventType = "text-delta"
+	// EventReasoningDelta 推理（思考）内容增量
+	EventReasoningDelta EventType = "reasoning-delta"
+	// EventFinish 生成结束
+	EventFinish EventType = "finish"
+	// EventError 上游返回的错误
+	EventError EventType = "error"
+	// EventUsage token 用量
+	EventUsage EventType = "usage"
+	// EventUnknown 无法识别或暂不处理的事件（start、text-start 等生命周期事件）
+	EventUnknown EventType = "unknown"
+)
+
+// Usage 上游返回的 token 用量
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+}
+
+// Event 解码后的上游事件
+type Event struct {
+	Type EventType
+	// Delta 文本或推理增量内容
+	Delta string
+	// FinishReason 结束原因（上游提供时）
+	FinishReason string
+	// Error 错误信息
+	Error string
+	// Usage token 用量
+	Usage *Usage
+	// Raw 原始 data 内容
+	Raw string
+}
+
+// rawEvent 上游 data 行的 JSON 结构
+type rawEvent struct {
+	Type            string    `json:"type"`
+	Delta           string    `json:"delta"`
+	Text            string    `json:"text"`
+	ErrorText       string    `json:"errorText"`
+	FinishReason    string    `json:"finishReason"`
+	Usage           *rawUsage `json:"usage"`
+	MessageMetadata *struct {
+		Usage *rawUsage `json:"usage"`
+	} `json:"messageMetadata"`
+}
+
+// rawUsage 兼容不同命名风格的用量字段
+type rawUsage struct {
+	InputTokens      int `json:"inputTokens"`
+	OutputTokens     int `json:"outputTokens"`
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+}
+
+func (u *rawUsage) toUsage() *Usage {
+	if u == nil {
+		return nil
+	}
+	usage := &Usage{InputTokens: u.InputTokens, OutputTokens: u.OutputTokens}
+	if usage.InputTokens == 0 {
+		usage.InputTokens = u.PromptTokens
+	}
+	if usage.OutputTokens == 0 {
+		usage.OutputTokens = u.CompletionTokens
+	}
+	return usage
+}
+
+// Decoder 增量解码器
+// 上游数据可能在任意位置被切分，不完整的行会缓存到下一次 Feed
+type Decoder struct {
+	buf strings.Builder
+}
+
+// NewDecoder 创建解码器
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Feed 写入一段数据，返回其中完整行解码出的事件
+func (d *Decoder) Feed(chunk string) []Event {
+	d.buf.WriteString(chunk)
+	content := d.buf.String()
+
+	idx := strings.LastIndexByte(content, '\n')
+	if idx < 0 {
+		return nil
+	}
+	d.buf.Reset()
+	d.buf.WriteString(content[idx+1:])
+
+	var events []Event
+	for _, line := range strings.Split(content[:idx], "\n") {
+		events = append(events, ParseLine(line)...)
+	}
+	return events
+}
+
+// Flush 解码缓冲区中剩余的不完整行（上游结束时调用）
+func (d *Decoder) Flush() []Event {
+	rest := d.buf.String()
+	d.buf.Reset()
+	return ParseLine(rest)
+}
+
+// ParseLine 解码单行 SSE 数据
+// 非 data 行、空行和 [DONE] 标记不产生事件；一行可能产生多个事件（如带用量的 finish）
+func ParseLine(line string) []Event {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasPrefix(line, "data:") {
+		return nil
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" || data == "[DONE]" {
+		return nil
+	}
+
+	var raw rawEvent
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return []Event{{Type: EventUnknown, Raw: data}}
+	}
+
+	usage := raw.Usage.toUsage()
+	if usage == nil && raw.MessageMetadata != nil {
+		usage = raw.MessageMetadata.Usage.toUsage()
+	}
+
+	var events []Event
+	if usage != nil {
+		events = append(events, Event{Type: EventUsage, Usage: usage, Raw: data})
+	}
+
+	switch raw.Type {
+	case "text-delta":
+		events = append(events, Event{Type: EventTextDelta, Delta: raw.Delta, Raw: data})
+	case "reasoning-delta":
+		events = append(events, Event{Type: EventReasoningDelta, Delta: raw.Delta, Raw: data})
+	case "reasoning":
+		// 旧版协议：推理内容放在 text 字段
+		events = append(events, Event{Type: EventReasoningDelta, Delta: raw.Text, Raw: data})
+	case "finish":
+		events = append(events, Event{Type: EventFinish, FinishReason: raw.FinishReason, Raw: data})
+	case "error":
+		errText := raw.ErrorText
+		if errText == "" {
+			errText = data
+		}
+		events = append(events, Event{Type: EventError, Error: errText, Raw: data})
+	case "message-metadata":
+		// 仅携带用量等元数据，已在上面处理
+	default:
+		events = append(events, Event{Type: EventUnknown, Raw: data})
+	}
+	return events
+}
@@ -0,0 +1,128 @@
+package sse
+
+import (
+	"reflect"
+	"testing"
+)
+
+// decodeCase 一段上游响应及期望解码出的事件（不比较 Raw）
+type decodeCase struct {
+	name  string
+	input string
+	want  []Event
+}
+
+var decodeCases = []decodeCase{
+	{
+		name:  "text deltas",
+		input: "data: {\"type\":\"text-delta\",\"delta\":\"Hel\"}\n\ndata: {\"type\":\"text-delta\",\"delta\":\"lo\"}\n\n",
+		want: []Event{
+			{Type: EventTextDelta, Delta: "Hel"},
+			{Type: EventTextDelta, Delta: "lo"},
+		},
+	},
+	{
+		name:  "crlf line endings",
+		input: "data: {\"type\":\"text-delta\",\"delta\":\"a\"}\r\n\r\ndata: {\"type\":\"text-delta\",\"delta\":\"b\"}\r\n\r\n",
+		want: []Event{
+			{Type: EventTextDelta, Delta: "a"},
+			{Type: EventTextDelta, Delta: "b"},
+		},
+	},
+	{
+		name:  "done marker and non-data lines",
+		input: ": ping\nevent: message\ndata: {\"type\":\"text-delta\",\"delta\":\"x\"}\n\ndata: [DONE]\n\n",
+		want:  []Event{{Type: EventTextDelta, Delta: "x"}},
+	},
+	{
+		name:  "finish with usage on one line",
+		input: "data: {\"type\":\"finish\",\"finishReason\":\"stop\",\"messageMetadata\":{\"usage\":{\"inputTokens\":12,\"outputTokens\":34}}}\n\n",
+		want: []Event{
+			{Type: EventUsage, Usage: &Usage{InputTokens: 12, OutputTokens: 34}},
+			{Type: EventFinish, FinishReason: "stop"},
+		},
+	},
+	{
+		name:  "usage with prompt and completion tokens",
+		input: "data: {\"type\":\"message-metadata\",\"usage\":{\"promptTokens\":5,\"completionTokens\":7}}\n",
+		want:  []Event{{Type: EventUsage, Usage: &Usage{InputTokens: 5, OutputTokens: 7}}},
+	},
+	{
+		name:  "reasoning in both protocol versions",
+		input: "data: {\"type\":\"reasoning-delta\",\"delta\":\"think\"}\ndata: {\"type\":\"reasoning\",\"text\":\"more\"}\n",
+		want: []Event{
+			{Type: EventReasoningDelta, Delta: "think"},
+			{Type: EventReasoningDelta, Delta: "more"},
+		},
+	},
+	{
+		name:  "error event",
+		input: "data: {\"type\":\"error\",\"errorText\":\"rate limited\"}\n\n",
+		want:  []Event{{Type: EventError, Error: "rate limited"}},
+	},
+	{
+		name:  "unknown and invalid json",
+		input: "data: {\"type\":\"start\"}\ndata: {not json\n",
+		want:  []Event{{Type: EventUnknown}, {Type: EventUnknown}},
+	},
+	{
+		name:  "multibyte text",
+		input: "data: {\"type\":\"text-delta\",\"delta\":\"你好，世界\"}\n",
+		want:  []Event{{Type: EventTextDelta, Delta: "你好，世界"}},
+	},
+	{
+		name:  "last line without newline",
+		input: "data: {\"type\":\"text-delta\",\"delta\":\"a\"}\ndata: {\"type\":\"text-delta\",\"delta\":\"b\"}",
+		want: []Event{
+			{Type: EventTextDelta, Delta: "a"},
+			{Type: EventTextDelta, Delta: "b"},
+		},
+	},
+}
+
+// stripRaw 去掉 Raw 字段，便于与期望值比较
+func stripRaw(events []Event) []Event {
+	out := make([]Event, 0, len(events))
+	for _, ev := range events {
+		ev.Raw = ""
+		out = append(out, ev)
+	}
+	return out
+}
+
+// decodeChunks 按给定分片依次 Feed，最后 Flush
+func decodeChunks(chunks ...string) []Event {
+	d := NewDecoder()
+	var events []Event
+	for _, chunk := range chunks {
+		events = append(events, d.Feed(chunk)...)
+	}
+	return stripRaw(append(events, d.Flush()...))
+}
+
+func TestDecoderSplitAtEveryOffset(t *testing.T) {
+	for _, tc := range decodeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i <= len(tc.input); i++ {
+				got := decodeChunks(tc.input[:i], tc.input[i:])
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("split at %d: got %+v, want %+v", i, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoderByteByByte(t *testing.T) {
+	for _, tc := range decodeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := make([]string, len(tc.input))
+			for i := 0; i < len(tc.input); i++ {
+				chunks[i] = tc.input[i : i+1]
+			}
+			if got := decodeChunks(chunks...); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
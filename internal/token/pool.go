@@ -2,6 +2,7 @@
 package token
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -12,6 +13,7 @@ import (
 
 	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
 
 	"github.com/enetx/g"
 	"github.com/enetx/surf"
@@ -30,11 +32,12 @@ type Pool struct {
 	mu         sync.RWMutex
 	envJS      string
 	mainJS     string
-	stopChan   chan struct{}
-	nextID     int32 // 用于生成 token 名称
-	hitCount   int64 // 缓存命中次数
-	missCount  int64 // 缓存未命中次数
-	poolSize   int   // 轮询池大小
+	ctx        context.Context    // 后台预热和刷新使用，Close 时取消
+	cancel     context.CancelFunc // 取消 ctx
+	nextID     int32              // 用于生成 token 名称
+	hitCount   int64              // 缓存命中次数
+	missCount  int64              // 缓存未命中次数
+	poolSize   int                // 轮询池大小
 }
 
 // TokenEntry Token 条目
@@ -72,14 +75,21 @@ func GetPool() *Pool {
 			poolSize:   poolSize,
 		}
 		instance.init()
+		instance.registerMetrics()
 	})
 	return instance
 }
 
 func (p *Pool) init() {
-	// 初始化 HTTP 客户端
-	p.client = surf.NewClient().Builder().Impersonate().Chrome().Build()
-	p.stopChan = make(chan struct{})
+	// 初始化 HTTP 客户端（与聊天客户端使用相同的代理配置）
+	// 获取验证脚本不是流式请求，timeout 直接作为总超时；为 0 时显式设置，否则 surf 默认 30 秒
+	builder := surf.NewClient().Builder().Impersonate().Chrome().
+		Timeout(time.Duration(p.cfg.Timeout) * time.Second)
+	if p.cfg.Proxy != "" {
+		builder = builder.Proxy(p.cfg.Proxy)
+	}
+	p.client = builder.Build()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
 	// 加载 JS 模板
 	envJS, err := os.ReadFile("jscode/env.js")
@@ -97,7 +107,7 @@ func (p *Pool) init() {
 	// 预生成轮询 token 池
 	log.Info("预热 %d 个 token...", p.poolSize)
 	for i := 0; i < p.poolSize; i++ {
-		tokenStr, err := p.generateToken()
+		tokenStr, err := p.generateToken(p.ctx)
 		if err != nil {
 			log.Error("预热 token %d 失败: %v", i+1, err)
 			continue
@@ -120,7 +130,7 @@ func (p *Pool) init() {
 
 // preWarmToken 预热 token
 func (p *Pool) preWarmToken(apiKey string) {
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateToken(p.ctx)
 	if err != nil {
 		log.Error("Pre-warm failed: %v", err)
 		return
@@ -154,7 +164,7 @@ func (p *Pool) backgroundRefresh() {
 		select {
 		case <-ticker.C:
 			p.refreshAllTokens()
-		case <-p.stopChan:
+		case <-p.ctx.Done():
 			return
 		}
 	}
@@ -173,12 +183,16 @@ func (p *Pool) refreshAllTokens() {
 	log.Info("后台刷新完成 (轮询池: %d)", poolLen)
 }
 
-// GetToken 获取 Token（每次生成新 token）
-func (p *Pool) GetToken(apiKey string) (string, error) {
+// GetToken 获取 Token（每次生成新 token），ctx 取消时中止生成
+func (p *Pool) GetToken(ctx context.Context, apiKey string) (string, error) {
 	// 每次请求生成新 token，避免被 Cursor 检测到重复使用
 	log.Debug("生成新 token...")
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateToken(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		atomic.AddInt64(&p.missCount, 1)
 		log.Error("生成 token 失败: %v", err)
 		return "", err
 	}
@@ -205,7 +219,7 @@ func (p *Pool) refreshRoundRobinToken(idx int) {
 		return
 	}
 
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateToken(p.ctx)
 	if err != nil {
 		log.Error("刷新 %s 失败: %v", entry.Name, err)
 		return
@@ -236,7 +250,7 @@ func (p *Pool) refreshToken(apiKey string) (string, error) {
 		return entry.Token, nil
 	}
 
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateToken(p.ctx)
 	if err != nil {
 		return "", err
 	}
@@ -283,14 +297,41 @@ func (p *Pool) List() []map[string]any {
 	return result
 }
 
-// generateToken 使用 Node.js 生成 token
-func (p *Pool) generateToken() (string, error) {
+// registerMetrics 注册 token 池的统计指标
+func (p *Pool) registerMetrics() {
+	metrics.NewCounterFunc("cursor2api_token_pool_hits_total", "请求时成功获取 token 的次数", func() float64 {
+		return float64(atomic.LoadInt64(&p.hitCount))
+	})
+	metrics.NewCounterFunc("cursor2api_token_pool_misses_total", "请求时获取 token 失败的次数", func() float64 {
+		return float64(atomic.LoadInt64(&p.missCount))
+	})
+	metrics.NewGaugeFunc("cursor2api_token_pool_size", "token 池中的 token 数", func() float64 {
+		return float64(p.Count())
+	})
+}
+
+// generateToken 使用 Node.js 生成 token，记录耗时和失败次数
+func (p *Pool) generateToken(ctx context.Context) (string, error) {
+	start := time.Now()
+	tokenStr, err := p.runTokenScript(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			metrics.TokenGenerationFailures.Inc()
+		}
+		return "", err
+	}
+	metrics.TokenGenerationDuration.Observe(time.Since(start).Seconds())
+	return tokenStr, nil
+}
+
+// runTokenScript 获取验证脚本并使用 Node.js 执行
+func (p *Pool) runTokenScript(ctx context.Context) (string, error) {
 	if p.cfg.ScriptURL == "" {
 		return "", fmt.Errorf("script_url not configured")
 	}
 
 	// 获取 Cursor 脚本
-	cursorJS, err := p.fetchCursorScript()
+	cursorJS, err := p.fetchCursorScript(ctx)
 	if err != nil {
 		return "", fmt.Errorf("fetch cursor script: %w", err)
 	}
@@ -313,7 +354,7 @@ func (p *Pool) generateToken() (string, error) {
 	tmpFile.Close()
 
 	// 使用 Node.js 执行临时文件
-	cmd := exec.Command("node", tmpPath)
+	cmd := exec.CommandContext(ctx, "node", tmpPath)
 	output, err := cmd.Output()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -326,7 +367,7 @@ func (p *Pool) generateToken() (string, error) {
 }
 
 // fetchCursorScript 获取 Cursor 验证脚本
-func (p *Pool) fetchCursorScript() (string, error) {
+func (p *Pool) fetchCursorScript(ctx context.Context) (string, error) {
 	headers := map[string]string{
 		"sec-ch-ua-arch":             `"x86"`,
 		"sec-ch-ua-platform":         `"Windows"`,
@@ -341,7 +382,7 @@ func (p *Pool) fetchCursorScript() (string, error) {
 		"accept-language":            "zh-CN,zh;q=0.9,en;q=0.8",
 	}
 
-	resp := p.client.Get(g.String(p.cfg.ScriptURL)).SetHeaders(headers).Do()
+	resp := p.client.Get(g.String(p.cfg.ScriptURL)).SetHeaders(headers).WithContext(ctx).Do()
 	if resp.IsErr() {
 		return "", fmt.Errorf("fetch script: %w", resp.Err())
 	}
@@ -363,9 +404,10 @@ func (p *Pool) buildJSCode(cursorJS string) string {
 	return replacer.Replace(p.mainJS)
 }
 
-// Close 关闭 Token 池
+// Close 关闭 Token 池：停止后台刷新并中止正在进行的后台 token 生成，可重复调用
 func (p *Pool) Close() {
-	close(p.stopChan)
+	p.cancel()
+	log.Info("Token 池已关闭")
 }
 
 func truncateKey(s string) string {
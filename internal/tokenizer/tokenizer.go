@@ -0,0 +1,143 @@
+// Package tokenizer 提供 BPE token 计数，词表随程序打包，无需联网下载
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"cursor2api/internal/logger"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+var log = logger.Get().WithPrefix("Tokenizer")
+
+// encodingName 使用的 BPE 词表
+const encodingName = "cl100k_base"
+
+// messageOverhead 每条消息的角色、分隔符等额外 token
+const messageOverhead = 4
+
+var (
+	encoding *tiktoken.Tiktoken
+	initOnce sync.Once
+)
+
+// get 延迟加载词表，加载失败时返回 nil 并退回到按字符估算
+func get() *tiktoken.Tiktoken {
+	initOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+		enc, err := tiktoken.GetEncoding(encodingName)
+		if err != nil {
+			log.Error("加载词表 %s 失败, 按字符数估算 token: %v", encodingName, err)
+			return
+		}
+		encoding = enc
+	})
+	return encoding
+}
+
+// Count 返回文本的 token 数
+func Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	enc := get()
+	if enc == nil {
+		// 每 4 个字符约 1 个 token
+		return (len(text) + 3) / 4
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// Truncate 返回文本开头不超过 n 个 token 的部分
+func Truncate(text string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	enc := get()
+	if enc == nil {
+		if len(text) <= n*4 {
+			return text
+		}
+		return strings.ToValidUTF8(text[:n*4], "")
+	}
+	tokens := enc.EncodeOrdinary(text)
+	if len(tokens) <= n {
+		return text
+	}
+	// 截断位置可能落在多字节字符中间，丢弃不完整的字符
+	return strings.ToValidUTF8(enc.Decode(tokens[:n]), "")
+}
+
+// CountMessages 返回多条消息的 token 数，包含每条消息的固定开销
+func CountMessages(texts []string) int {
+	total := 0
+	for _, text := range texts {
+		total += Count(text) + messageOverhead
+	}
+	return total
+}
+
+const (
+	// counterWindow Counter 末尾未结算文本超过该字节数时结算一次
+	counterWindow = 2048
+	// counterKeep 结算时保留在末尾重新统计的 token 数，避免切分位置影响相邻 token 的合并
+	counterKeep = 16
+)
+
+// Counter 增量统计流式输出的 token 数
+// 对每个分片单独计数再相加会因为 BPE 无法跨分片合并而多算，Counter 只对末尾一段文本重新计数，
+// 结果与统计完整文本基本一致
+type Counter struct {
+	// base 已结算部分的 token 数
+	base int
+	// tail 末尾尚未结算的文本
+	tail string
+}
+
+// Add 追加文本，返回目前全部文本的 token 数
+func (c *Counter) Add(text string) int {
+	c.tail += text
+	n := c.base + Count(c.tail)
+	c.compact()
+	return n
+}
+
+// AddLimited 追加文本，使全部文本不超过 max 个 token
+// 返回实际追加的部分，超出时截断并返回 true，之后的输入应丢弃
+func (c *Counter) AddLimited(text string, max int) (string, bool) {
+	prev := c.tail
+	c.tail += text
+	if c.base+Count(c.tail) <= max {
+		c.compact()
+		return text, false
+	}
+	kept := Truncate(c.tail, max-c.base)
+	out := ""
+	if len(kept) > len(prev) && strings.HasPrefix(kept, prev) {
+		out = kept[len(prev):]
+	}
+	c.tail = prev + out
+	return out, true
+}
+
+// compact 末尾文本过长时，把除最后 counterKeep 个 token 之外的部分结算到 base
+func (c *Counter) compact() {
+	enc := get()
+	if enc == nil || len(c.tail) < counterWindow {
+		return
+	}
+	tokens := enc.EncodeOrdinary(c.tail)
+	// 保留的文本必须从完整的字符开始，否则之后重新计数和截断都会出错
+	for keep := counterKeep; keep < len(tokens); keep++ {
+		tail := enc.Decode(tokens[len(tokens)-keep:])
+		if utf8.ValidString(tail) && strings.HasSuffix(c.tail, tail) {
+			c.base += len(tokens) - keep
+			c.tail = tail
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package tokenizer
+
+import (
+	"strings"
+	"testing"
+)
+
+// sampleText 混合英文、代码和中文的长文本，长度超过 Counter 的结算窗口
+var sampleText = strings.Repeat("The quick brown fox jumps over the lazy dog. "+
+	"func main() { fmt.Println(\"hello, world\") }\n"+
+	"你好，世界！这是一段用于统计 token 的中文文本。\n", 40)
+
+// chunks 按固定字节数切分文本，会切开多字节字符
+func chunks(text string, size int) []string {
+	var out []string
+	for len(text) > size {
+		out = append(out, text[:size])
+		text = text[size:]
+	}
+	return append(out, text)
+}
+
+func TestCounterMatchesWholeText(t *testing.T) {
+	want := Count(sampleText)
+	for _, size := range []int{1, 3, 7, 64} {
+		var c Counter
+		got := 0
+		for _, chunk := range chunks(sampleText, size) {
+			got = c.Add(chunk)
+		}
+		// 结算位置可能影响相邻 token 的合并，允许极小的误差
+		if diff := got - want; diff < -2 || diff > 2 {
+			t.Errorf("chunk size %d: got %d tokens, want %d", size, got, want)
+		}
+	}
+
+	naive := 0
+	for _, chunk := range chunks(sampleText, 3) {
+		naive += Count(chunk)
+	}
+	if naive <= want {
+		t.Fatalf("expected per-chunk counting to overcount, got %d <= %d", naive, want)
+	}
+}
+
+func TestCounterAddLimited(t *testing.T) {
+	limit := Count(sampleText) / 2
+	for _, size := range []int{1, 5, 64} {
+		var c Counter
+		var out strings.Builder
+		truncated := false
+		for _, chunk := range chunks(sampleText, size) {
+			part, cut := c.AddLimited(chunk, limit)
+			out.WriteString(part)
+			if cut {
+				truncated = true
+				break
+			}
+		}
+		if !truncated {
+			t.Fatalf("chunk size %d: expected truncation", size)
+		}
+		if !strings.HasPrefix(sampleText, out.String()) {
+			t.Fatalf("chunk size %d: output is not a prefix of the input", size)
+		}
+		// 输出应接近上限，而不是因为多算提前截断
+		if n := Count(out.String()); n > limit || n < limit-3 {
+			t.Errorf("chunk size %d: output has %d tokens, limit %d", size, n, limit)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package toolify
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ToolChoice 调用方对工具调用的约束
+type ToolChoice struct {
+	// Type auto（由模型决定，默认）、any（至少调用一个工具）、tool（必须调用 Name 指定的工具）、none（不调用工具）
+	Type string
+	// Name Type 为 tool 时必须调用的工具名称
+	Name string
+	// DisableParallel 每次回复最多调用一个工具
+	DisableParallel bool
+}
+
+// ChoiceError 模型的回复没有满足 tool_choice 的要求
+type ChoiceError struct {
+	Choice ToolChoice
+}
+
+func (e *ChoiceError) Error() string {
+	if e.Choice.Type == "tool" {
+		return fmt.Sprintf("模型未调用 tool_choice 指定的工具 %s", e.Choice.Name)
+	}
+	return "模型未调用工具，但 tool_choice 要求至少调用一个工具"
+}
+
+// Allows 检查是否允许调用该工具，Type 为 tool 时只允许指定的工具
+func (c ToolChoice) Allows(name string) bool {
+	return c.Type != "tool" || strings.EqualFold(name, c.Name)
+}
+
+// ChoicePrompt 生成追加在工具提示词之后的约束说明，没有约束时返回空字符串
+func ChoicePrompt(choice ToolChoice) string {
+	var rules []string
+	switch choice.Type {
+	case "any":
+		rules = append(rules, "- You must call at least one tool in this response. Do not answer with text only.")
+	case "tool":
+		rules = append(rules, fmt.Sprintf("- You must call the tool %q in this response and no other tool. Do not answer with text only.", choice.Name))
+	}
+	if choice.DisableParallel {
+		rules = append(rules, "- Call at most one tool in this response.")
+	}
+	if len(rules) == 0 {
+		return ""
+	}
+	return "\n## Tool choice\n\n" + strings.Join(rules, "\n") + "\n"
+}
+
+// CheckChoice 检查工具调用是否满足 tool_choice，不满足时返回 *ChoiceError
+func CheckChoice(choice ToolChoice, calls []ToolCall) error {
+	switch choice.Type {
+	case "any":
+		if len(calls) > 0 {
+			return nil
+		}
+	case "tool":
+		for _, call := range calls {
+			if choice.Allows(call.Function.Name) {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+	return &ChoiceError{Choice: choice}
+}
+
+// ChoiceCorrectionPrompt 生成纠正提示，要求模型按 tool_choice 调用工具
+func ChoiceCorrectionPrompt(choice ToolChoice) string {
+	if choice.Type == "tool" {
+		return fmt.Sprintf("Your previous response did not call the tool %q, but calling it is required. Calls to other tools were discarded, do not repeat them. Output only the call to %q, with arguments that satisfy its input JSON schema.", choice.Name, choice.Name)
+	}
+	return "Your previous response did not call any tool, but a tool call is required. Do not repeat your previous answer. Output only the call to the most appropriate tool, with arguments that satisfy its input JSON schema."
+}
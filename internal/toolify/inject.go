@@ -0,0 +1,37 @@
+package toolify
+
+import "cursor2api/internal/client"
+
+// InjectPrompt 把工具提示词和 tool_choice 约束注入到第一条用户消息的开头，返回新的消息列表和注入的提示词
+// 通用模式每轮都注入工具定义；虚拟机模式只在第一次调用时注入（hasToolResult 为 false）
+// 不需要注入时原样返回 messages 和空字符串；注入时不修改 messages 中原有的消息
+func InjectPrompt(messages []client.CursorMessage, tools []ToolDefinition, choice ToolChoice, hasToolResult bool) ([]client.CursorMessage, string) {
+	if len(tools) == 0 || (CurrentMode() == ModeVM && hasToolResult) {
+		return messages, ""
+	}
+	prompt := GenerateToolPrompt(tools) + ChoicePrompt(choice)
+
+	for i, msg := range messages {
+		if msg.Role != "user" {
+			continue
+		}
+		parts := make([]client.CursorPart, 0, len(msg.Parts)+1)
+		if len(msg.Parts) > 0 && msg.Parts[0].Type == "text" {
+			text := prompt
+			if msg.Parts[0].Text != "" {
+				text += "\n\n" + msg.Parts[0].Text
+			}
+			parts = append(parts, client.CursorPart{Type: "text", Text: text})
+			parts = append(parts, msg.Parts[1:]...)
+		} else {
+			parts = append(parts, client.CursorPart{Type: "text", Text: prompt})
+			parts = append(parts, msg.Parts...)
+		}
+
+		injected := make([]client.CursorMessage, len(messages))
+		copy(injected, messages)
+		injected[i].Parts = parts
+		return injected, prompt
+	}
+	return messages, ""
+}
@@ -0,0 +1,65 @@
+package toolify
+
+import (
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+func textMessage(role, text string) client.CursorMessage {
+	return client.CursorMessage{Role: role, Parts: []client.CursorPart{{Type: "text", Text: text}}}
+}
+
+func TestInjectPrompt(t *testing.T) {
+	tools := []ToolDefinition{{Name: "get_weather", InputSchema: map[string]interface{}{"type": "object"}}}
+	choice := ToolChoice{Type: "tool", Name: "get_weather"}
+
+	t.Run("prepends to the first user message", func(t *testing.T) {
+		messages := []client.CursorMessage{textMessage("system", "be brief"), textMessage("user", "hi"), textMessage("user", "again")}
+		got, prompt := InjectPrompt(messages, tools, choice, false)
+		if prompt == "" || !strings.Contains(prompt, `"get_weather"`) {
+			t.Fatalf("prompt %q does not include the tool choice", prompt)
+		}
+		if got[1].Parts[0].Text != prompt+"\n\nhi" {
+			t.Errorf("first user message = %q", got[1].Parts[0].Text)
+		}
+		if got[0].Parts[0].Text != "be brief" || got[2].Parts[0].Text != "again" {
+			t.Errorf("other messages changed: %+v", got)
+		}
+		if messages[1].Parts[0].Text != "hi" {
+			t.Errorf("input messages were modified")
+		}
+	})
+
+	t.Run("adds a text part before images", func(t *testing.T) {
+		messages := []client.CursorMessage{{Role: "user", Parts: []client.CursorPart{{Type: "file", MediaType: "image/png", URL: "data:image/png;base64,AA=="}}}}
+		got, prompt := InjectPrompt(messages, tools, ToolChoice{}, false)
+		if len(got[0].Parts) != 2 || got[0].Parts[0].Text != prompt || got[0].Parts[1].Type != "file" {
+			t.Errorf("parts = %+v", got[0].Parts)
+		}
+	})
+
+	t.Run("no tools", func(t *testing.T) {
+		messages := []client.CursorMessage{textMessage("user", "hi")}
+		if got, prompt := InjectPrompt(messages, nil, ToolChoice{}, false); prompt != "" || got[0].Parts[0].Text != "hi" {
+			t.Errorf("got %q, %+v", prompt, got)
+		}
+	})
+
+	t.Run("vm mode skips after tool results", func(t *testing.T) {
+		cfg := config.Get()
+		mode := cfg.ToolMode
+		cfg.ToolMode = string(ModeVM)
+		defer func() { cfg.ToolMode = mode }()
+
+		messages := []client.CursorMessage{textMessage("user", "hi")}
+		if _, prompt := InjectPrompt(messages, tools, ToolChoice{}, true); prompt != "" {
+			t.Errorf("got prompt %q, want none", prompt)
+		}
+		if _, prompt := InjectPrompt(messages, tools, ToolChoice{}, false); prompt == "" {
+			t.Errorf("want prompt on the first call")
+		}
+	})
+}
@@ -0,0 +1,411 @@
+package toolify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ValidationError 工具调用参数不符合工具定义时返回的错误
+type ValidationError struct {
+	// Tool 工具名称
+	Tool string `json:"tool"`
+	// Issues 具体问题，如 "path: missing required field"（会回传给模型，使用英文）
+	Issues []string `json:"issues"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("工具 %s 调用参数无效: %s", e.Tool, strings.Join(e.Issues, "; "))
+}
+
+// ValidateToolCall 按调用方提供的 input_schema/parameters 校验工具调用，
+// 并修正明显的类型不匹配（如字符串 "3" 转为整数、JSON 字符串转为对象）。
+// 返回修正后的调用；无法修正时返回 *ValidationError
+// vm 模式下工具名固定为 Write/Bash/WebSearch/WebFetch，调用方没有同名工具时原样放行
+func ValidateToolCall(call ToolCall, tools []ToolDefinition) (ToolCall, error) {
+	tool, ok := FindTool(call.Function.Name, tools)
+	if !ok && CurrentMode() == ModeVM {
+		return call, nil
+	}
+	if !ok {
+		return call, &ValidationError{
+			Tool:   call.Function.Name,
+			Issues: []string{fmt.Sprintf("unknown tool, available tools: %s", strings.Join(toolNames(tools), ", "))},
+		}
+	}
+	// 修正工具名大小写
+	call.Function.Name = tool.GetName()
+
+	schema := tool.GetParameters()
+	if schema == nil {
+		return call, nil
+	}
+
+	var args interface{}
+	if err := decodeJSON(call.Function.Arguments, &args); err != nil {
+		return call, &ValidationError{Tool: call.Function.Name, Issues: []string{"arguments are not valid JSON: " + err.Error()}}
+	}
+
+	var issues []string
+	fixed := coerceValue(args, schema, "", &issues)
+	if len(issues) > 0 {
+		return call, &ValidationError{Tool: call.Function.Name, Issues: issues}
+	}
+
+	out, err := json.Marshal(fixed)
+	if err != nil {
+		return call, &ValidationError{Tool: call.Function.Name, Issues: []string{err.Error()}}
+	}
+	call.Function.Arguments = string(out)
+	return call, nil
+}
+
+// FindTool 按名称查找工具，名称完全匹配优先，其次忽略大小写
+func FindTool(name string, tools []ToolDefinition) (ToolDefinition, bool) {
+	for _, tool := range tools {
+		if tool.GetName() == name {
+			return tool, true
+		}
+	}
+	for _, tool := range tools {
+		if strings.EqualFold(tool.GetName(), name) {
+			return tool, true
+		}
+	}
+	return ToolDefinition{}, false
+}
+
+func toolNames(tools []ToolDefinition) []string {
+	names := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		if name := tool.GetName(); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// coerceValue 按 schema 校验并修正单个值，问题追加到 issues
+func coerceValue(value interface{}, schema map[string]interface{}, path string, issues *[]string) interface{} {
+	// anyOf/oneOf：取第一个无问题的分支
+	// 修正会原地修改对象和数组，每个分支使用副本，失败分支的修正不会影响之后的分支和返回值
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if branches, ok := schema[key].([]interface{}); ok && len(branches) > 0 {
+			for _, b := range branches {
+				branch, ok := b.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				var branchIssues []string
+				fixed := coerceValue(deepCopy(value), branch, path, &branchIssues)
+				if len(branchIssues) == 0 {
+					return fixed
+				}
+			}
+			*issues = append(*issues, fmt.Sprintf("%s: does not match any schema in %s", displayPath(path), key))
+			return value
+		}
+	}
+
+	types := schemaTypes(schema)
+	if len(types) > 0 && !matchesAny(value, types) {
+		converted, ok := convertValue(value, types)
+		if !ok {
+			*issues = append(*issues, fmt.Sprintf("%s: expected %s, got %s", displayPath(path), strings.Join(types, "|"), jsonType(value)))
+			return value
+		}
+		value = converted
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return coerceObject(v, schema, path, issues)
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				v[i] = coerceValue(item, items, fmt.Sprintf("%s[%d]", path, i), issues)
+			}
+		}
+		return v
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		return coerceEnum(value, enum, path, issues)
+	}
+	return value
+}
+
+// deepCopy 复制 JSON 解码得到的对象和数组，其他值原样返回
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = deepCopy(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = deepCopy(item)
+		}
+		return out
+	}
+	return value
+}
+
+// coerceObject 校验对象的必填字段和各属性
+func coerceObject(obj map[string]interface{}, schema map[string]interface{}, path string, issues *[]string) interface{} {
+	props, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, exists := obj[name]; !exists && name != "" {
+				*issues = append(*issues, fmt.Sprintf("%s: missing required field", joinPath(path, name)))
+			}
+		}
+	}
+
+	for name, val := range obj {
+		propSchema, ok := props[name].(map[string]interface{})
+		if !ok {
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional && props != nil {
+				*issues = append(*issues, fmt.Sprintf("%s: unexpected field, additional properties are not allowed", joinPath(path, name)))
+			}
+			continue
+		}
+		obj[name] = coerceValue(val, propSchema, joinPath(path, name), issues)
+	}
+	return obj
+}
+
+// coerceEnum 校验枚举值，字符串忽略大小写匹配
+func coerceEnum(value interface{}, enum []interface{}, path string, issues *[]string) interface{} {
+	for _, e := range enum {
+		if e == value {
+			return value
+		}
+		// 数字按数值比较（参数中为 json.Number，schema 中为 float64）
+		if n, ok := value.(json.Number); ok {
+			if f, ok := e.(float64); ok {
+				if v, err := n.Float64(); err == nil && v == f {
+					return value
+				}
+			}
+		}
+	}
+	if s, ok := value.(string); ok {
+		for _, e := range enum {
+			if es, ok := e.(string); ok && strings.EqualFold(es, s) {
+				return es
+			}
+		}
+	}
+	allowed := make([]string, len(enum))
+	for i, e := range enum {
+		b, _ := json.Marshal(e)
+		allowed[i] = string(b)
+	}
+	*issues = append(*issues, fmt.Sprintf("%s: must be one of %s", displayPath(path), strings.Join(allowed, ", ")))
+	return value
+}
+
+// schemaTypes 返回 schema 声明的类型列表
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	// 未声明类型但有 properties，按对象处理
+	if _, ok := schema["properties"]; ok {
+		return []string{"object"}
+	}
+	return nil
+}
+
+func matchesAny(value interface{}, types []string) bool {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(value interface{}, t string) bool {
+	switch t {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		return ok && isInteger(n)
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+// convertValue 尝试把值转换为目标类型之一
+func convertValue(value interface{}, types []string) (interface{}, bool) {
+	for _, t := range types {
+		if converted, ok := convertTo(value, t); ok {
+			return converted, true
+		}
+	}
+	return nil, false
+}
+
+func convertTo(value interface{}, t string) (interface{}, bool) {
+	switch t {
+	case "integer":
+		if s, ok := value.(string); ok {
+			if n, ok := parseNumber(s); ok && isInteger(n) {
+				// "3.0" 这类写法转为不带小数部分的整数
+				if f, err := n.Float64(); err == nil && strings.ContainsAny(n.String(), ".eE") {
+					return json.Number(strconv.FormatInt(int64(f), 10)), true
+				}
+				return n, true
+			}
+		}
+	case "number":
+		if s, ok := value.(string); ok {
+			if n, ok := parseNumber(s); ok {
+				return n, true
+			}
+		}
+	case "boolean":
+		if s, ok := value.(string); ok {
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				return b, true
+			}
+		}
+	case "string":
+		switch v := value.(type) {
+		case json.Number:
+			return v.String(), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case "object":
+		if s, ok := value.(string); ok {
+			var obj map[string]interface{}
+			if decodeJSON(s, &obj) == nil {
+				return obj, true
+			}
+		}
+	case "array":
+		if s, ok := value.(string); ok {
+			var arr []interface{}
+			if decodeJSON(s, &arr) == nil {
+				return arr, true
+			}
+		}
+		// 单个值包装为数组
+		if value != nil {
+			return []interface{}{value}, true
+		}
+	}
+	return nil, false
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if isInteger(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// decodeJSON 解析 JSON，数字保留为 json.Number，避免超过 2^53 的整数（ID、偏移量等）丢失精度
+func decodeJSON(data string, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// parseNumber 把字符串形式的数字转换为 json.Number，保留原始精度
+func parseNumber(s string) (json.Number, bool) {
+	s = strings.TrimSpace(s)
+	if _, err := strconv.ParseFloat(s, 64); err != nil || !json.Valid([]byte(s)) {
+		return "", false
+	}
+	return json.Number(s), true
+}
+
+// isInteger 检查数字是否为整数，1.0、1e3 这类没有小数部分的写法也视为整数
+func isInteger(n json.Number) bool {
+	if !strings.ContainsAny(n.String(), ".eE") {
+		return true
+	}
+	f, err := n.Float64()
+	return err == nil && f == float64(int64(f))
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "(arguments)"
+	}
+	return path
+}
+
+// CorrectionPrompt 生成纠正提示，要求模型按 schema 重新输出工具调用
+func CorrectionPrompt(errs []*ValidationError) string {
+	var b strings.Builder
+	b.WriteString("Your previous tool call(s) were rejected because the arguments do not match the tool's input JSON schema:\n")
+	for _, e := range errs {
+		b.WriteString(fmt.Sprintf("- %s: %s\n", e.Tool, strings.Join(e.Issues, "; ")))
+	}
+	b.WriteString("Tool calls not listed here were accepted, do not repeat them. Output only the corrected tool call(s), using only the available tool names and satisfying every required field and type in the schema.")
+	return b.String()
+}
@@ -0,0 +1,149 @@
+package toolify
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/config"
+)
+
+// testTools 测试用的工具定义，同时覆盖 Anthropic 和 OpenAI 两种格式
+func testTools(t *testing.T) []ToolDefinition {
+	t.Helper()
+	var tools []ToolDefinition
+	err := json.Unmarshal([]byte(`[
+		{"name": "read", "input_schema": {
+			"type": "object",
+			"properties": {
+				"path": {"type": "string"},
+				"offset": {"type": "integer"},
+				"ratio": {"type": "number"},
+				"force": {"type": "boolean"},
+				"mode": {"type": "string", "enum": ["text", "binary"]},
+				"level": {"type": "integer", "enum": [1, 2, 3]},
+				"tags": {"type": "array", "items": {"type": "string"}},
+				"options": {"type": "object", "properties": {"depth": {"type": "integer"}}}
+			},
+			"required": ["path"]
+		}},
+		{"type": "function", "function": {"name": "strict", "parameters": {
+			"type": "object",
+			"properties": {"id": {"anyOf": [{"type": "integer"}, {"type": "null"}]}},
+			"additionalProperties": false
+		}}},
+		{"name": "free"},
+		{"name": "union", "input_schema": {
+			"type": "object",
+			"properties": {"spec": {"anyOf": [
+				{"type": "object", "properties": {"count": {"type": "integer"}, "kind": {"enum": ["a"]}}},
+				{"type": "object", "properties": {"count": {"type": "string"}, "kind": {"type": "string"}}}
+			]}}
+		}}
+	]`), &tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tools
+}
+
+func TestValidateToolCallCoercion(t *testing.T) {
+	cases := []struct {
+		name     string
+		tool     string
+		args     string
+		wantName string
+		wantArgs string
+	}{
+		{name: "valid unchanged", tool: "read", args: `{"path":"a.go"}`, wantArgs: `{"path":"a.go"}`},
+		{name: "string to integer", tool: "read", args: `{"path":"a","offset":"3"}`, wantArgs: `{"offset":3,"path":"a"}`},
+		{name: "float string to integer", tool: "read", args: `{"path":"a","offset":"3.0"}`, wantArgs: `{"offset":3,"path":"a"}`},
+		{name: "string to number", tool: "read", args: `{"path":"a","ratio":" 0.5 "}`, wantArgs: `{"path":"a","ratio":0.5}`},
+		{name: "string to boolean", tool: "read", args: `{"path":"a","force":"true"}`, wantArgs: `{"force":true,"path":"a"}`},
+		{name: "number to string", tool: "read", args: `{"path":12}`, wantArgs: `{"path":"12"}`},
+		{name: "enum case", tool: "read", args: `{"path":"a","mode":"TEXT"}`, wantArgs: `{"mode":"text","path":"a"}`},
+		{name: "json string to array", tool: "read", args: `{"path":"a","tags":"[\"x\",\"y\"]"}`, wantArgs: `{"path":"a","tags":["x","y"]}`},
+		{name: "single value to array", tool: "read", args: `{"path":"a","tags":"x"}`, wantArgs: `{"path":"a","tags":["x"]}`},
+		{name: "json string to object", tool: "read", args: `{"path":"a","options":"{\"depth\":\"2\"}"}`, wantArgs: `{"options":{"depth":2},"path":"a"}`},
+		{name: "tool name case", tool: "READ", args: `{"path":"a"}`, wantName: "read", wantArgs: `{"path":"a"}`},
+		{name: "anyOf branch", tool: "strict", args: `{"id":"7"}`, wantArgs: `{"id":7}`},
+		{name: "large integers keep precision", tool: "read", args: `{"path":"a","offset":9007199254740993}`, wantArgs: `{"offset":9007199254740993,"path":"a"}`},
+		{name: "large integer string", tool: "read", args: `{"path":"a","offset":"9007199254740993"}`, wantArgs: `{"offset":9007199254740993,"path":"a"}`},
+		{name: "integer to string keeps digits", tool: "read", args: `{"path":12345678901234567890}`, wantArgs: `{"path":"12345678901234567890"}`},
+		{name: "numeric enum", tool: "read", args: `{"path":"a","level":"2"}`, wantArgs: `{"level":2,"path":"a"}`},
+		{name: "no schema", tool: "free", args: `{"anything":"goes"}`, wantArgs: `{"anything":"goes"}`},
+		{name: "failed anyOf branch leaves no fixes", tool: "union", args: `{"spec":{"count":"3.0","kind":"b"}}`, wantArgs: `{"spec":{"count":"3.0","kind":"b"}}`},
+	}
+	tools := testTools(t)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			call := ToolCall{Type: "function", Function: ToolCallFunction{Name: tc.tool, Arguments: tc.args}}
+			got, err := ValidateToolCall(call, tools)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			wantName := tc.wantName
+			if wantName == "" {
+				wantName = tc.tool
+			}
+			if got.Function.Name != wantName {
+				t.Errorf("name = %q, want %q", got.Function.Name, wantName)
+			}
+			if got.Function.Arguments != tc.wantArgs {
+				t.Errorf("arguments = %s, want %s", got.Function.Arguments, tc.wantArgs)
+			}
+		})
+	}
+}
+
+func TestValidateToolCallIssues(t *testing.T) {
+	cases := []struct {
+		name  string
+		tool  string
+		args  string
+		issue string
+	}{
+		{name: "unknown tool", tool: "write", args: `{}`, issue: "unknown tool"},
+		{name: "invalid json", tool: "read", args: `{"path":`, issue: "not valid JSON"},
+		{name: "missing required", tool: "read", args: `{}`, issue: "path: missing required field"},
+		{name: "wrong type", tool: "read", args: `{"path":"a","offset":"three"}`, issue: "offset: expected integer, got string"},
+		{name: "enum mismatch", tool: "read", args: `{"path":"a","mode":"hex"}`, issue: "mode: must be one of"},
+		{name: "numeric enum mismatch", tool: "read", args: `{"path":"a","level":4}`, issue: "level: must be one of 1, 2, 3"},
+		{name: "nested field", tool: "read", args: `{"path":"a","options":{"depth":"deep"}}`, issue: "options.depth: expected integer"},
+		{name: "anyOf mismatch", tool: "strict", args: `{"id":"x"}`, issue: "does not match any schema in anyOf"},
+		{name: "additional property", tool: "strict", args: `{"id":1,"extra":1}`, issue: "extra: unexpected field"},
+		{name: "fractional integer", tool: "read", args: `{"path":"a","offset":1.5}`, issue: "offset: expected integer, got number"},
+		{name: "trailing data", tool: "read", args: `{"path":"a"} {}`, issue: "not valid JSON"},
+	}
+	tools := testTools(t)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			call := ToolCall{Type: "function", Function: ToolCallFunction{Name: tc.tool, Arguments: tc.args}}
+			_, err := ValidateToolCall(call, tools)
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if !strings.Contains(strings.Join(verr.Issues, "; "), tc.issue) {
+				t.Errorf("issues %q do not mention %q", verr.Issues, tc.issue)
+			}
+		})
+	}
+}
+
+func TestValidateToolCallVMModePassesThroughFixedTools(t *testing.T) {
+	cfg := config.Get()
+	mode := cfg.ToolMode
+	cfg.ToolMode = string(ModeVM)
+	defer func() { cfg.ToolMode = mode }()
+
+	call := ToolCall{Type: "function", Function: ToolCallFunction{Name: "Bash", Arguments: `{"command":"ls"}`}}
+	got, err := ValidateToolCall(call, testTools(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != call {
+		t.Errorf("got %+v, want the call unchanged", got)
+	}
+}
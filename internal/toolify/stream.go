@@ -0,0 +1,171 @@
+package toolify
+
+import "strings"
+
+// StreamEvent 流式解析产生的事件，Text 和 ToolCall 只会设置其一
+type StreamEvent struct {
+	// Text 可直接展示给客户端的文本
+	Text string
+	// ToolCall 完整解析出的工具调用
+	ToolCall *ToolCall
+}
+
+// toolTag 工具调用标签的开始和结束标记
+type toolTag struct {
+	open  string
+	close string
+	// attrs 开始标记后还带有属性（如 <vm_write path="...">）
+	attrs bool
+}
+
+var (
+	genericTags = []toolTag{{open: "<tool_call>", close: "</tool_call>"}}
+	vmTags      = []toolTag{
+		{open: "<vm_write", close: "</vm_write>", attrs: true},
+		{open: "<vm_exec>", close: "</vm_exec>"},
+		{open: "<vm_search>", close: "</vm_search>"},
+		{open: "<vm_fetch>", close: "</vm_fetch>"},
+	}
+)
+
+// StreamParser 增量识别模型输出中的工具调用标签
+// 标签内容不会作为文本输出，每个调用在结束标签到达时立即返回
+type StreamParser struct {
+	tags []toolTag
+	// buf 尚未输出的内容，处于标签中时以开始标记开头
+	buf strings.Builder
+	// scanned 标签块中已查找过结束标记的长度，新数据到达时只查找之后的部分
+	scanned int
+	// current 当前所在的标签，nil 表示处于普通文本中
+	current *toolTag
+}
+
+// NewStreamParser 按当前工具调用模式创建流式解析器
+func NewStreamParser() *StreamParser {
+	tags := genericTags
+	if CurrentMode() == ModeVM {
+		tags = vmTags
+	}
+	return &StreamParser{tags: tags}
+}
+
+// Feed 输入一段文本增量，返回可以确定的事件
+// 可能是标签开头的内容会被暂存，直到能够判断为止
+func (p *StreamParser) Feed(delta string) []StreamEvent {
+	p.buf.WriteString(delta)
+	buf := p.buf.String()
+	var events []StreamEvent
+
+	for buf != "" {
+		if p.current != nil {
+			// 结束标记可能跨越上次查找的末尾
+			from := max(p.scanned-len(p.current.close)+1, 0)
+			end := strings.Index(buf[from:], p.current.close)
+			if end < 0 {
+				p.scanned = len(buf)
+				break
+			}
+			end += from + len(p.current.close)
+			events = append(events, parseBlock(buf[:end])...)
+			buf = buf[end:]
+			p.current = nil
+			p.scanned = 0
+			continue
+		}
+
+		start := strings.IndexByte(buf, '<')
+		if start < 0 {
+			events = appendText(events, buf)
+			buf = ""
+			break
+		}
+		events = appendText(events, buf[:start])
+		buf = buf[start:]
+
+		tag, pending := p.matchTag(buf)
+		if pending {
+			break
+		}
+		if tag == nil {
+			events = appendText(events, "<")
+			buf = buf[1:]
+			continue
+		}
+		p.current = tag
+	}
+
+	// 只在有内容输出后重建缓冲区，标签块未结束时不复制
+	if len(buf) != p.buf.Len() {
+		p.buf.Reset()
+		p.buf.WriteString(buf)
+	}
+	return events
+}
+
+// Flush 上游结束时调用，输出暂存的内容
+// 缺少结束标签的调用会尝试补全后解析，失败则按原文输出
+func (p *StreamParser) Flush() []StreamEvent {
+	buf := p.buf.String()
+	var events []StreamEvent
+	if p.current != nil {
+		if calls, _ := ParseToolCalls(buf + p.current.close); len(calls) > 0 {
+			events = callEvents(calls)
+			buf = ""
+		}
+	}
+	events = appendText(events, buf)
+	p.buf.Reset()
+	p.scanned = 0
+	p.current = nil
+	return events
+}
+
+// matchTag 判断 buf 开头是否为工具标签
+// pending 为 true 表示内容不足以判断，需要等待更多数据
+func (p *StreamParser) matchTag(buf string) (tag *toolTag, pending bool) {
+	for i := range p.tags {
+		t := &p.tags[i]
+		if strings.HasPrefix(buf, t.open) {
+			if !t.attrs {
+				return t, false
+			}
+			// 带属性的标签要求后面紧跟空白，避免误判 <vm_writer> 之类的文本
+			if len(buf) == len(t.open) {
+				return nil, true
+			}
+			if next := buf[len(t.open)]; next == ' ' || next == '\t' || next == '\n' {
+				return t, false
+			}
+			continue
+		}
+		if strings.HasPrefix(t.open, buf) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// parseBlock 解析一个完整的标签块，无法解析时按原文输出
+func parseBlock(block string) []StreamEvent {
+	calls, _ := ParseToolCalls(block)
+	if len(calls) == 0 {
+		return appendText(nil, block)
+	}
+	return callEvents(calls)
+}
+
+// callEvents 将解析出的工具调用转为事件
+func callEvents(calls []ToolCall) []StreamEvent {
+	events := make([]StreamEvent, len(calls))
+	for i := range calls {
+		events[i] = StreamEvent{ToolCall: &calls[i]}
+	}
+	return events
+}
+
+func appendText(events []StreamEvent, text string) []StreamEvent {
+	if text == "" {
+		return events
+	}
+	return append(events, StreamEvent{Text: text})
+}
@@ -0,0 +1,131 @@
+package toolify
+
+import (
+	"strings"
+	"testing"
+)
+
+// streamResult 合并后的文本和工具调用（名称与参数）
+type streamResult struct {
+	text  string
+	calls []string
+}
+
+// runStream 按分片输入解析器并合并事件
+func runStream(chunks []string) streamResult {
+	p := NewStreamParser()
+	var res streamResult
+	collect := func(events []StreamEvent) {
+		for _, ev := range events {
+			if ev.ToolCall != nil {
+				res.calls = append(res.calls, ev.ToolCall.Function.Name+" "+ev.ToolCall.Function.Arguments)
+				continue
+			}
+			res.text += ev.Text
+		}
+	}
+	for _, chunk := range chunks {
+		collect(p.Feed(chunk))
+	}
+	collect(p.Flush())
+	return res
+}
+
+func equalResult(a, b streamResult) bool {
+	if a.text != b.text || len(a.calls) != len(b.calls) {
+		return false
+	}
+	for i := range a.calls {
+		if a.calls[i] != b.calls[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStreamParser(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  streamResult
+	}{
+		{
+			name:  "plain text",
+			input: "a < b and c > d",
+			want:  streamResult{text: "a < b and c > d"},
+		},
+		{
+			name:  "single call",
+			input: "Reading.\n<tool_call>{\"name\":\"read\",\"arguments\":{\"path\":\"a.go\"}}</tool_call>",
+			want:  streamResult{text: "Reading.\n", calls: []string{`read {"path":"a.go"}`}},
+		},
+		{
+			name: "two calls with text between",
+			input: "<tool_call>{\"name\":\"a\",\"arguments\":{}}</tool_call> and " +
+				"<tool_call>{\"name\":\"b\",\"parameters\":{\"x\":1}}</tool_call>",
+			want: streamResult{text: " and ", calls: []string{"a {}", `b {"x":1}`}},
+		},
+		{
+			name:  "similar tag is text",
+			input: "<tool_calls> is not a tag",
+			want:  streamResult{text: "<tool_calls> is not a tag"},
+		},
+		{
+			name:  "invalid call body is text",
+			input: "<tool_call>not json</tool_call>",
+			want:  streamResult{text: "<tool_call>not json</tool_call>"},
+		},
+		{
+			name:  "missing close tag is completed on flush",
+			input: "<tool_call>{\"name\":\"ls\",\"arguments\":{\"dir\":\".\"}}",
+			want:  streamResult{calls: []string{`ls {"dir":"."}`}},
+		},
+		{
+			name:  "dangling tag prefix is released on flush",
+			input: "text <tool_ca",
+			want:  streamResult{text: "text <tool_ca"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := runStream([]string{tc.input}); !equalResult(got, tc.want) {
+				t.Fatalf("whole: got %+v, want %+v", got, tc.want)
+			}
+			for i := 0; i <= len(tc.input); i++ {
+				if got := runStream([]string{tc.input[:i], tc.input[i:]}); !equalResult(got, tc.want) {
+					t.Fatalf("split at %d: got %+v, want %+v", i, got, tc.want)
+				}
+			}
+			chunks := make([]string, len(tc.input))
+			for i := 0; i < len(tc.input); i++ {
+				chunks[i] = tc.input[i : i+1]
+			}
+			if got := runStream(chunks); !equalResult(got, tc.want) {
+				t.Fatalf("byte by byte: got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStreamParserEmitsCallBeforeStreamEnds(t *testing.T) {
+	p := NewStreamParser()
+	events := p.Feed("<tool_call>{\"name\":\"a\",\"arguments\":{}}</tool_call>")
+	if len(events) != 1 || events[0].ToolCall == nil {
+		t.Fatalf("expected the call as soon as the close tag arrives, got %+v", events)
+	}
+}
+
+// BenchmarkStreamParserLongCall 长工具调用按小分片输入，耗时应与长度成线性关系
+func BenchmarkStreamParserLongCall(b *testing.B) {
+	input := "<tool_call>{\"name\":\"write\",\"arguments\":{\"content\":\"" +
+		strings.Repeat("x", 256<<10) + "\"}}</tool_call>"
+	for i := 0; i < b.N; i++ {
+		p := NewStreamParser()
+		for j := 0; j < len(input); j += 16 {
+			p.Feed(input[j:min(j+16, len(input))])
+		}
+		if events := p.Flush(); len(events) != 0 {
+			b.Fatalf("unexpected events on flush: %+v", events)
+		}
+	}
+}
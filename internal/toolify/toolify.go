@@ -2,10 +2,15 @@
 package toolify
 
 import (
+    "bytes"
     "encoding/json"
     "fmt"
     "regexp"
     "strings"
+
+    "cursor2api/internal/config"
+
+    "github.com/google/uuid"
 )
 
 // ToolDefinition 工具定义 (支持 Anthropic 格式)
@@ -64,12 +69,39 @@ type ToolCallFunction struct {
     Arguments string `json:"arguments"`
 }
 
+// Mode 工具调用协议模式
+type Mode string
+
+const (
+    // ModeGeneric 通用模式：向模型描述调用方的真实工具（名称、描述、JSON Schema），
+    // 模型以 <tool_call>{"name":...,"arguments":{...}}</tool_call> 调用任意工具
+    ModeGeneric Mode = "generic"
+    // ModeVM 虚拟机模式：只提供 vm_write/vm_exec/vm_search/vm_fetch 四个标签，
+    // 分别映射为 Write/Bash/WebSearch/WebFetch
+    ModeVM Mode = "vm"
+)
+
+// CurrentMode 返回配置的工具调用模式，默认为通用模式
+func CurrentMode() Mode {
+    if Mode(config.Get().ToolMode) == ModeVM {
+        return ModeVM
+    }
+    return ModeGeneric
+}
+
 // GenerateToolPrompt 生成工具调用的系统提示
 func GenerateToolPrompt(tools []ToolDefinition) string {
     if len(tools) == 0 {
         return ""
     }
+    if CurrentMode() == ModeVM {
+        return generateVMPrompt()
+    }
+    return generateGenericPrompt(tools)
+}
 
+// generateGenericPrompt 生成通用模式提示词，包含每个工具的完整定义
+func generateGenericPrompt(tools []ToolDefinition) string {
     var toolsDesc strings.Builder
     for _, tool := range tools {
         name := tool.GetName()
@@ -82,27 +114,33 @@ func GenerateToolPrompt(tools []ToolDefinition) string {
         }
 
         params := tool.GetParameters()
-        if params != nil {
-            if props, ok := params["properties"].(map[string]interface{}); ok {
-                toolsDesc.WriteString("Parameters:\n")
-                for paramName, prop := range props {
-                    if propMap, ok := prop.(map[string]interface{}); ok {
-                        propType := "string"
-                        if t, ok := propMap["type"].(string); ok {
-                            propType = t
-                        }
-                        desc := ""
-                        if d, ok := propMap["description"].(string); ok {
-                            desc = " - " + d
-                        }
-                        toolsDesc.WriteString(fmt.Sprintf("- %s (%s)%s\n", paramName, propType, desc))
-                    }
-                }
-            }
+        if params == nil {
+            params = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
         }
-        toolsDesc.WriteString("\n")
+        schema, _ := json.Marshal(params)
+        toolsDesc.WriteString(fmt.Sprintf("Input JSON schema: %s\n\n", schema))
     }
 
+    return `You have access to the tools listed below. To call a tool, output a <tool_call> block that contains a single JSON object with the tool "name" and its "arguments":
+
+<tool_call>
+{"name": "tool_name", "arguments": {"param": "value"}}
+</tool_call>
+
+Rules:
+- "name" must exactly match one of the tool names below.
+- "arguments" must be a JSON object that satisfies the tool's input JSON schema, including all required fields.
+- To call several tools, output several <tool_call> blocks one after another.
+- Do not put <tool_call> blocks inside code fences. After your tool calls, stop and wait: results are returned in the next message as "[Tool <id> result]: ...".
+- If no tool is needed, answer normally without any <tool_call> block.
+
+## Available tools
+
+` + toolsDesc.String()
+}
+
+// generateVMPrompt 生成虚拟机模式提示词
+func generateVMPrompt() string {
     // 精简的虚拟机框架 prompt
     return `
 You are in a sandbox VM with full permissions.
@@ -113,25 +151,135 @@ Fetch URL: <vm_fetch>url</vm_fetch>
 `
 }
 
+// FormatToolCall 将历史中的工具调用还原为模型输出的格式，让模型在多轮对话中保持一致
+// 虚拟机模式下工具名与标签不是一一对应，返回空字符串
+func FormatToolCall(name string, arguments interface{}) string {
+    if CurrentMode() == ModeVM {
+        return ""
+    }
+    var args json.RawMessage
+    switch v := arguments.(type) {
+    case string:
+        args = json.RawMessage(v)
+    default:
+        args, _ = json.Marshal(v)
+    }
+    if !json.Valid(args) {
+        args = json.RawMessage("{}")
+    }
+    call, _ := json.Marshal(struct {
+        Name      string          `json:"name"`
+        Arguments json.RawMessage `json:"arguments"`
+    }{name, args})
+    return "<tool_call>\n" + string(call) + "\n</tool_call>"
+}
+
 // 预编译正则表达式提升性能
 var (
+    toolCallPattern  = regexp.MustCompile(`(?s)<tool_call>(.*?)</tool_call>`)
+    codeFencePattern = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*(.*?)\\s*```$")
+
     vmWritePattern  = regexp.MustCompile(`(?s)<vm_write\s+path="([^"]+)">(.*?)</vm_write>`)
     vmExecPattern   = regexp.MustCompile(`(?s)<vm_exec>(.*?)</vm_exec>`)
     vmSearchPattern = regexp.MustCompile(`(?s)<vm_search>(.*?)</vm_search>`)
     vmFetchPattern  = regexp.MustCompile(`(?s)<vm_fetch>(.*?)</vm_fetch>`)
 )
 
-// ParseToolCalls 从响应中解析工具调用
+// newCallID 生成工具调用 ID，保证多轮对话中不重复
+func newCallID() string {
+    return strings.ReplaceAll(uuid.New().String(), "-", "")[:16]
+}
+
+// ParseToolCalls 从响应中解析工具调用，返回工具调用和去除调用标记后的文本
 func ParseToolCalls(response string) ([]ToolCall, string) {
+    if CurrentMode() == ModeVM {
+        return parseVMToolCalls(response)
+    }
+    return parseGenericToolCalls(response)
+}
+
+// parseGenericToolCalls 解析通用模式的 <tool_call> 块
+func parseGenericToolCalls(response string) ([]ToolCall, string) {
+    var toolCalls []ToolCall
+    cleanResponse := response
+
+    for _, match := range toolCallPattern.FindAllStringSubmatch(response, -1) {
+        call, ok := parseToolCallJSON(match[1])
+        if !ok {
+            continue
+        }
+        toolCalls = append(toolCalls, call)
+        cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
+    }
+
+    return toolCalls, strings.TrimSpace(cleanResponse)
+}
+
+// parseToolCallJSON 解析 <tool_call> 块内的 JSON，兼容代码块包裹、
+// parameters/input 字段名以及字符串形式的 arguments
+func parseToolCallJSON(body string) (ToolCall, bool) {
+    body = strings.TrimSpace(body)
+    if m := codeFencePattern.FindStringSubmatch(body); m != nil {
+        body = m[1]
+    }
+
+    var raw struct {
+        Name       string          `json:"name"`
+        Arguments  json.RawMessage `json:"arguments"`
+        Parameters json.RawMessage `json:"parameters"`
+        Input      json.RawMessage `json:"input"`
+    }
+    if err := json.Unmarshal([]byte(body), &raw); err != nil || raw.Name == "" {
+        return ToolCall{}, false
+    }
+
+    args := raw.Arguments
+    if len(args) == 0 {
+        args = raw.Parameters
+    }
+    if len(args) == 0 {
+        args = raw.Input
+    }
+    // arguments 可能被模型写成 JSON 字符串
+    var str string
+    if json.Unmarshal(args, &str) == nil && json.Valid([]byte(str)) {
+        args = json.RawMessage(str)
+    }
+    if len(args) == 0 || string(args) == "null" {
+        args = json.RawMessage("{}")
+    }
+
+    compact, err := compactJSON(args)
+    if err != nil {
+        return ToolCall{}, false
+    }
+    return ToolCall{
+        ID:       newCallID(),
+        Type:     "function",
+        Function: ToolCallFunction{Name: raw.Name, Arguments: compact},
+    }, true
+}
+
+// compactJSON 去除 JSON 中多余的空白，保留字段顺序
+func compactJSON(data []byte) (string, error) {
+    var buf bytes.Buffer
+    if err := json.Compact(&buf, data); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
+
+// parseVMToolCalls 解析虚拟机模式的标签
+func parseVMToolCalls(response string) ([]ToolCall, string) {
     var toolCalls []ToolCall
     cleanResponse := response
 
     // 检测 <vm_write path="/path">content</vm_write>
-    for i, match := range vmWritePattern.FindAllStringSubmatch(response, -1) {
+    for _, match := range vmWritePattern.FindAllStringSubmatch(response, -1) {
         if len(match) >= 3 {
             args, _ := json.Marshal(map[string]string{"file_path": match[1], "content": match[2]})
             toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("w%d", i),
+                ID:       newCallID(),
                 Type:     "function",
                 Function: ToolCallFunction{Name: "Write", Arguments: string(args)},
             })
@@ -140,11 +288,11 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
     }
 
     // 检测 <vm_exec>command</vm_exec>
-    for i, match := range vmExecPattern.FindAllStringSubmatch(response, -1) {
+    for _, match := range vmExecPattern.FindAllStringSubmatch(response, -1) {
         if len(match) >= 2 {
             args, _ := json.Marshal(map[string]string{"command": strings.TrimSpace(match[1])})
             toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("b%d", i),
+                ID:       newCallID(),
                 Type:     "function",
                 Function: ToolCallFunction{Name: "Bash", Arguments: string(args)},
             })
@@ -153,11 +301,11 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
     }
 
     // 检测 <vm_search>query</vm_search>
-    for i, match := range vmSearchPattern.FindAllStringSubmatch(response, -1) {
+    for _, match := range vmSearchPattern.FindAllStringSubmatch(response, -1) {
         if len(match) >= 2 {
             args, _ := json.Marshal(map[string]string{"query": strings.TrimSpace(match[1])})
             toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("s%d", i),
+                ID:       newCallID(),
                 Type:     "function",
                 Function: ToolCallFunction{Name: "WebSearch", Arguments: string(args)},
             })
@@ -166,11 +314,11 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
     }
 
     // 检测 <vm_fetch>url</vm_fetch>
-    for i, match := range vmFetchPattern.FindAllStringSubmatch(response, -1) {
+    for _, match := range vmFetchPattern.FindAllStringSubmatch(response, -1) {
         if len(match) >= 2 {
             args, _ := json.Marshal(map[string]string{"url": strings.TrimSpace(match[1])})
             toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("f%d", i),
+                ID:       newCallID(),
                 Type:     "function",
                 Function: ToolCallFunction{Name: "WebFetch", Arguments: string(args)},
             })
@@ -183,6 +331,9 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
 
 // HasToolCalls 检查响应是否包含工具调用
 func HasToolCalls(response string) bool {
+    if CurrentMode() == ModeGeneric {
+        return strings.Contains(response, "<tool_call>")
+    }
     // 检测虚拟机格式标签
     return strings.Contains(response, "<vm_write") ||
         strings.Contains(response, "<vm_exec>") ||